@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// answerCache is an LRU cache of /ask answers. Entries expire after ttl and
+// are dropped for a bank whenever its memories change. A zero ttl disables
+// the cache.
+type answerCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	lru   *list.List // of *answerEntry, most recently used first
+	items map[string]*list.Element
+	// gens counts invalidations per bank, and cleared those of the whole
+	// cache, so an answer computed before an invalidation is never stored
+	// after it
+	gens    map[string]uint64
+	cleared uint64
+}
+
+type answerEntry struct {
+	key     string
+	bankID  string
+	resp    AskResponse
+	expires time.Time
+}
+
+func newAnswerCache(ttl time.Duration, size int) *answerCache {
+	return &answerCache{
+		ttl:   ttl,
+		size:  size,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+		gens:  make(map[string]uint64),
+	}
+}
+
+func (c *answerCache) enabled() bool {
+	return c.ttl > 0 && c.size > 0
+}
+
+// get returns the cached answer for key, if it hasn't expired, along with
+// the bank's generation to pass to put on a miss.
+func (c *answerCache) get(bankID, key string) (AskResponse, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen := c.gens[bankID] + c.cleared
+	el, ok := c.items[key]
+	if !ok {
+		answerCacheLookups.WithLabelValues("miss").Inc()
+		return AskResponse{}, gen, false
+	}
+	entry := el.Value.(*answerEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		answerCacheLookups.WithLabelValues("miss").Inc()
+		return AskResponse{}, gen, false
+	}
+	c.lru.MoveToFront(el)
+	answerCacheLookups.WithLabelValues("hit").Inc()
+	return entry.resp, gen, true
+}
+
+// put caches resp under key unless the bank was invalidated since gen was
+// read, evicting the least recently used entry when full.
+func (c *answerCache) put(bankID, key string, gen uint64, resp AskResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gens[bankID]+c.cleared != gen {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&answerEntry{
+		key:     key,
+		bankID:  bankID,
+		resp:    resp,
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops every cached answer for bankID.
+func (c *answerCache) invalidate(bankID string) {
+	if !c.enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gens[bankID]++
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*answerEntry).bankID == bankID {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// clear drops every cached answer and returns how many there were.
+func (c *answerCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.lru.Len()
+	c.cleared++
+	c.lru.Init()
+	clear(c.items)
+	return n
+}
+
+func (c *answerCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*answerEntry).key)
+}
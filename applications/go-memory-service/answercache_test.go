@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnswerCache(t *testing.T) {
+	c := newAnswerCache(time.Minute, 2)
+
+	_, gen, ok := c.get("user-alice", "a")
+	if ok {
+		t.Fatal("get on an empty cache hit")
+	}
+	c.put("user-alice", "a", gen, AskResponse{Answer: "A"})
+	if resp, _, ok := c.get("user-alice", "a"); !ok || resp.Answer != "A" {
+		t.Errorf("get after put = %+v, %v; want A", resp, ok)
+	}
+
+	// An answer computed before an invalidation must not be cached after it
+	_, gen, _ = c.get("user-alice", "b")
+	c.invalidate("user-alice")
+	c.put("user-alice", "b", gen, AskResponse{Answer: "B"})
+	if _, _, ok := c.get("user-alice", "a"); ok {
+		t.Error("invalidate kept an entry for the bank")
+	}
+	if _, _, ok := c.get("user-alice", "b"); ok {
+		t.Error("put with a stale generation was cached")
+	}
+
+	// The least recently used entry is evicted when full
+	for _, key := range []string{"x", "y", "z"} {
+		_, gen, _ := c.get("user-bob", key)
+		c.put("user-bob", key, gen, AskResponse{Answer: key})
+	}
+	if _, _, ok := c.get("user-bob", "x"); ok {
+		t.Error("oldest entry survived eviction")
+	}
+	if _, _, ok := c.get("user-bob", "z"); !ok {
+		t.Error("newest entry was evicted")
+	}
+
+	// Clearing drops everything, and answers computed before it
+	_, gen, _ = c.get("user-carol", "c")
+	if n := c.clear(); n != 2 {
+		t.Errorf("clear = %d, want 2", n)
+	}
+	c.put("user-carol", "c", gen, AskResponse{Answer: "C"})
+	if _, _, ok := c.get("user-carol", "c"); ok {
+		t.Error("put with a generation from before clear was cached")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// backgroundTask is a unit of fire-and-forget work. ctx is only used to log
+// with the request ID of the request that queued it.
+type backgroundTask struct {
+	name    string
+	ctx     context.Context
+	fn      func()
+	started time.Time
+}
+
+// backgroundTasks runs work that outlives the request that started it, like
+// storing an /ask interaction, on workers goroutines with up to size tasks
+// waiting for one, so a flood of requests can't start goroutines without
+// bound. A task that finds the queue full is dropped and logged. Tasks
+// running longer than stuckAfter are reported as stuck: every task has its
+// own deadline, so one that outlives it points at a leak.
+//
+// wg tracks queued and running tasks, and /learn/async jobs, so shutdown
+// can drain them.
+type backgroundTasks struct {
+	workers    int
+	size       int
+	stuckAfter time.Duration
+
+	start sync.Once
+	queue chan *backgroundTask
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[*backgroundTask]struct{}
+	dropped int
+}
+
+// background runs the process's fire-and-forget work (BACKGROUND_WORKERS,
+// BACKGROUND_QUEUE, BACKGROUND_STUCK_AFTER).
+var background = &backgroundTasks{workers: 16, size: 1000, stuckAfter: 5 * time.Minute}
+
+var (
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "memory_service_background_tasks_running",
+		Help: "Background tasks, like stored /ask interactions, currently running.",
+	}, func() float64 { return float64(background.status().Running) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "memory_service_background_tasks_queued",
+		Help: "Background tasks waiting for a worker.",
+	}, func() float64 { return float64(background.status().Queued) })
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "memory_service_background_tasks_stuck",
+		Help: "Background tasks running for longer than any task should.",
+	}, func() float64 { return float64(background.status().Stuck) })
+	backgroundDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memory_service_background_tasks_dropped_total",
+		Help: "Background tasks dropped because the queue was full.",
+	})
+)
+
+// run queues fn as the task name, reporting false if it was dropped.
+func (b *backgroundTasks) run(ctx context.Context, name string, fn func()) bool {
+	b.start.Do(func() {
+		b.mu.Lock()
+		b.queue = make(chan *backgroundTask, b.size)
+		b.mu.Unlock()
+		for range b.workers {
+			go b.work()
+		}
+	})
+
+	b.wg.Add(1)
+	select {
+	case b.queue <- &backgroundTask{name: name, ctx: ctx, fn: fn}:
+		return true
+	default:
+		b.wg.Done()
+		b.mu.Lock()
+		b.dropped++
+		b.mu.Unlock()
+		backgroundDropped.Inc()
+		slog.WarnContext(ctx, "background queue full, task dropped", "task", name, "queue_size", b.size)
+		return false
+	}
+}
+
+func (b *backgroundTasks) work() {
+	for t := range b.queue {
+		b.runTask(t)
+	}
+}
+
+func (b *backgroundTasks) runTask(t *backgroundTask) {
+	t.started = time.Now()
+	b.mu.Lock()
+	if b.running == nil {
+		b.running = make(map[*backgroundTask]struct{})
+	}
+	b.running[t] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		// A panicking task mustn't take its worker, or the process, with it
+		if v := recover(); v != nil {
+			slog.ErrorContext(t.ctx, "background task panic",
+				"task", t.name,
+				"panic", fmt.Sprint(v),
+				"stack", string(debug.Stack()),
+			)
+		}
+		if d := time.Since(t.started); b.stuckAfter > 0 && d > b.stuckAfter {
+			slog.WarnContext(t.ctx, "stuck background task finished", "task", t.name, "duration", d)
+		}
+		b.mu.Lock()
+		delete(b.running, t)
+		b.mu.Unlock()
+		b.wg.Done()
+	}()
+	t.fn()
+}
+
+// wait blocks until all queued and running tasks finish or ctx ends.
+func (b *backgroundTasks) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BackgroundStatus is the state of the background tasks on
+// /debug/background. StuckTasks lists the tasks running for longer than
+// stuck_after_seconds, longest first.
+type BackgroundStatus struct {
+	Workers           int         `json:"workers"`
+	QueueSize         int         `json:"queue_size"`
+	Queued            int         `json:"queued"`
+	Running           int         `json:"running"`
+	Dropped           int         `json:"dropped"`
+	StuckAfterSeconds float64     `json:"stuck_after_seconds"`
+	Stuck             int         `json:"stuck"`
+	StuckTasks        []StuckTask `json:"stuck_tasks,omitempty"`
+}
+
+// StuckTask is a background task running for too long.
+type StuckTask struct {
+	Task           string  `json:"task"`
+	RequestID      string  `json:"request_id,omitempty"`
+	RunningSeconds float64 `json:"running_seconds"`
+}
+
+func (b *backgroundTasks) status() BackgroundStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BackgroundStatus{
+		Workers:           b.workers,
+		QueueSize:         b.size,
+		Queued:            len(b.queue),
+		Running:           len(b.running),
+		Dropped:           b.dropped,
+		StuckAfterSeconds: b.stuckAfter.Seconds(),
+	}
+	for t := range b.running {
+		if d := time.Since(t.started); b.stuckAfter > 0 && d > b.stuckAfter {
+			status.StuckTasks = append(status.StuckTasks, StuckTask{Task: t.name, RequestID: requestID(t.ctx), RunningSeconds: d.Seconds()})
+		}
+	}
+	slices.SortFunc(status.StuckTasks, func(a, b StuckTask) int { return cmp.Compare(b.RunningSeconds, a.RunningSeconds) })
+	status.Stuck = len(status.StuckTasks)
+	return status
+}
+
+// handleDebugBackground reports the background tasks, to spot a backlog or
+// tasks that never finish. It never fails, so it is safe to poll.
+func handleDebugBackground(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, background.status())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackgroundTasks(t *testing.T) {
+	b := &backgroundTasks{workers: 1, size: 1, stuckAfter: 20 * time.Millisecond}
+	ctx := context.Background()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	// One task runs, one waits, and the queue is then full
+	if !b.run(ctx, "blocked", func() { close(started); <-release }) {
+		t.Fatal("first task dropped")
+	}
+	<-started
+	if !b.run(ctx, "panics", func() { panic("boom") }) {
+		t.Fatal("queued task dropped")
+	}
+	if b.run(ctx, "dropped", func() { t.Error("dropped task ran") }) {
+		t.Error("task queued past the queue size")
+	}
+	if s := b.status(); s.Running != 1 || s.Queued != 1 || s.Dropped != 1 {
+		t.Errorf("status = %+v, want 1 running, 1 queued, 1 dropped", s)
+	}
+
+	time.Sleep(b.stuckAfter)
+	if s := b.status(); s.Stuck != 1 || s.StuckTasks[0].Task != "blocked" {
+		t.Errorf("status = %+v, want the blocked task stuck", s)
+	}
+
+	// The panic is recovered, and the worker lives on to drain the queue
+	close(release)
+	if err := b.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	b.run(ctx, "after panic", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker gone after a panicking task")
+	}
+	b.wait(ctx)
+	if s := b.status(); s.Running != 0 || s.Queued != 0 || s.Stuck != 0 {
+		t.Errorf("status = %+v after draining, want idle", s)
+	}
+}
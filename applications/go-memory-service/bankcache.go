@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bankCache remembers which banks have been ensured during this process
+// lifetime so handlers can skip redundant existence checks. Entries
+// expire after ttl so banks are periodically re-ensured, and concurrent
+// callers for the same bank share a single in-flight ensure.
+type bankCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	ensured  map[string]time.Time
+	inflight map[string]chan struct{}
+	// seen records when each bank was last used, and by which user, for
+	// periodic re-ensures
+	seen map[string]seenBank
+}
+
+type seenBank struct {
+	userID string
+	at     time.Time
+}
+
+func newBankCache(ttl time.Duration) *bankCache {
+	return &bankCache{
+		ttl:      ttl,
+		ensured:  make(map[string]time.Time),
+		inflight: make(map[string]chan struct{}),
+		seen:     make(map[string]seenBank),
+	}
+}
+
+// do runs ensure for bankID unless it succeeded within the TTL. If another
+// caller is already ensuring the same bank, do waits for it instead of
+// issuing a second call. Only successful ensures are cached.
+func (c *bankCache) do(ctx context.Context, bankID string, ensure func() bool) {
+	c.mu.Lock()
+	if at, ok := c.ensured[bankID]; ok && time.Since(at) < c.ttl {
+		c.mu.Unlock()
+		return
+	}
+	if done, ok := c.inflight[bankID]; ok {
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	done := make(chan struct{})
+	c.inflight[bankID] = done
+	c.mu.Unlock()
+
+	ok := ensure()
+
+	c.mu.Lock()
+	delete(c.inflight, bankID)
+	if ok {
+		c.ensured[bankID] = time.Now()
+	}
+	c.mu.Unlock()
+	close(done)
+}
+
+// forget drops bankID from the cache, e.g. after the bank is deleted.
+func (c *bankCache) forget(bankID string) {
+	c.mu.Lock()
+	delete(c.ensured, bankID)
+	c.mu.Unlock()
+}
+
+// clear forgets every ensured bank, so each is checked again on next use,
+// and returns how many there were.
+func (c *bankCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.ensured)
+	clear(c.ensured)
+	return n
+}
+
+// touch records that userID's bank was just used.
+func (c *bankCache) touch(bankID, userID string) {
+	c.mu.Lock()
+	c.seen[bankID] = seenBank{userID: userID, at: time.Now()}
+	c.mu.Unlock()
+}
+
+// recent returns the banks used since the given time, mapped to their user
+// IDs, and stops tracking the rest.
+func (c *bankCache) recent(since time.Time) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	banks := make(map[string]string)
+	for bankID, seen := range c.seen {
+		if seen.at.Before(since) {
+			delete(c.seen, bankID)
+			continue
+		}
+		banks[bankID] = seen.userID
+	}
+	return banks
+}
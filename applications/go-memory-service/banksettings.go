@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// BankSettings are a user's defaults for requests that leave them out, set
+// by operators through PUT /bank/{userID}/settings. Zero values mean the
+// service-wide default.
+//
+// Mission and Name are those set through PUT /bank/{userID}/mission, kept
+// so re-ensuring the bank doesn't put the templates back.
+type BankSettings struct {
+	DefaultBudget    hindsight.Budget `json:"default_budget,omitempty"`
+	DefaultMaxTokens int32            `json:"default_max_tokens,omitempty"`
+	Mission          string           `json:"mission,omitempty"`
+	Name             string           `json:"name,omitempty"`
+}
+
+// applyTo returns the budget and max_tokens for a request that asked for
+// budget (parsed from requested) and maxTokens, filling in the unset ones.
+func (d BankSettings) applyTo(requested string, budget hindsight.Budget, maxTokens int32) (hindsight.Budget, int32) {
+	if requested == "" && d.DefaultBudget != "" {
+		budget = d.DefaultBudget
+	}
+	if maxTokens == 0 {
+		// MAX_TOKENS_LIMIT may have been lowered since the default was set
+		maxTokens = min(d.DefaultMaxTokens, maxTokensLimit)
+	}
+	return budget, maxTokens
+}
+
+// bankSettingsStore holds BankSettings by bank ID. With a path
+// (BANK_SETTINGS_FILE) it is loaded from that JSON file at startup and
+// written back on every change, so settings survive restarts; without one
+// they last as long as the process. Either way each replica has its own.
+type bankSettingsStore struct {
+	path string
+
+	mu    sync.Mutex
+	banks map[string]BankSettings
+}
+
+func newBankSettingsStore() *bankSettingsStore {
+	return &bankSettingsStore{banks: make(map[string]BankSettings)}
+}
+
+// load reads the settings in the store's file. A missing file is empty.
+func (s *bankSettingsStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(data, &s.banks)
+}
+
+func (s *bankSettingsStore) get(bankID string) BankSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banks[bankID]
+}
+
+// set replaces the settings of bankID, dropping them if settings is zero,
+// and saves the store. On a failed save the change is undone.
+func (s *bankSettingsStore) set(bankID string, settings BankSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, had := s.banks[bankID]
+	if settings == (BankSettings{}) {
+		delete(s.banks, bankID)
+	} else {
+		s.banks[bankID] = settings
+	}
+	if err := s.save(); err != nil {
+		if had {
+			s.banks[bankID] = prev
+		} else {
+			delete(s.banks, bankID)
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes the store to its file, through a temporary file renamed into
+// place so a crash never leaves it half written. It needs s.mu.
+func (s *bankSettingsStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.banks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".bank-settings-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// BankSettingsResponse is a user's settings, as set and returned by
+// /bank/{userID}/settings.
+type BankSettingsResponse struct {
+	BankID string `json:"bank_id"`
+	BankSettings
+}
+
+// handleBankSettings returns the user's settings.
+func (s *Service) handleBankSettings(w http.ResponseWriter, r *http.Request) {
+	bankID, ok := requestBank(w, r, r.PathValue("userID"))
+	if !ok {
+		return
+	}
+	writeJSON(w, BankSettingsResponse{BankID: bankID, BankSettings: s.bankSettings.get(bankID)})
+}
+
+// handleUpdateBankSettings replaces the user's settings. Omitted fields go
+// back to the service-wide defaults, so {} clears them; the mission and
+// name, which belong to PUT /bank/{userID}/mission, are kept. The bank
+// itself isn't touched, and needn't exist yet.
+func (s *Service) handleUpdateBankSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DefaultBudget    string `json:"default_budget"`
+		DefaultMaxTokens int32  `json:"default_max_tokens"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var settings BankSettings
+	if req.DefaultBudget != "" {
+		budget, err := parseBudget(req.DefaultBudget)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+			return
+		}
+		settings.DefaultBudget = budget
+	}
+	if err := validMaxTokens(req.DefaultMaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	settings.DefaultMaxTokens = req.DefaultMaxTokens
+
+	bankID, ok := requestBank(w, r, r.PathValue("userID"))
+	if !ok {
+		return
+	}
+	annotateBank(r.Context(), bankID)
+
+	prev := s.bankSettings.get(bankID)
+	settings.Mission, settings.Name = prev.Mission, prev.Name
+	if err := s.bankSettings.set(bankID, settings); err != nil {
+		slog.ErrorContext(r.Context(), "saving bank settings failed", "path", s.bankSettings.path, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "saving the settings failed")
+		return
+	}
+
+	writeJSON(w, BankSettingsResponse{BankID: bankID, BankSettings: settings})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var errCircuitOpen = errors.New("hindsight circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+var (
+	breakerStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "memory_service_hindsight_breaker_state",
+		Help: "State of the hindsight circuit breaker: 0 closed, 1 half-open, 2 open.",
+	})
+	breakerTrips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memory_service_hindsight_breaker_trips_total",
+		Help: "Times the hindsight circuit breaker opened.",
+	})
+)
+
+// circuitBreaker stops calling hindsight once it keeps failing. After
+// threshold consecutive failed calls it opens, and calls fail at once with
+// errCircuitOpen for cooldown. Then a single call is let through as a
+// probe: if it succeeds the breaker closes, otherwise it opens for another
+// cooldown. A zero threshold disables it.
+//
+// Only hindsight's own failures count: 5xx responses, network errors and
+// timeouts. Other error responses mean hindsight is up, and canceled calls
+// and errOverloaded say nothing about it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// breaker guards every call made through execute (BREAKER_THRESHOLD,
+// BREAKER_COOLDOWN).
+var breaker = &circuitBreaker{threshold: 5, cooldown: 30 * time.Second}
+
+// allow reports whether a call may go ahead. A call it allows must be
+// followed by record.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// The probe is still running
+		return false
+	}
+	return true
+}
+
+// record notes the outcome of a call allow let through.
+func (b *circuitBreaker) record(httpResp *http.Response, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := httpResp != nil && httpResp.StatusCode >= http.StatusInternalServerError ||
+		httpResp == nil && err != nil
+	if errors.Is(err, context.Canceled) || errors.Is(err, errOverloaded) {
+		// Tells nothing about hindsight; a probe is retried by the next call
+		if b.state == breakerHalfOpen {
+			b.setState(breakerOpen)
+			b.openedAt = time.Time{}
+		}
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.trip()
+		} else {
+			b.failures = 0
+			b.setState(breakerClosed)
+		}
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.trip()
+		}
+	}
+	// Calls started before the breaker opened are ignored
+}
+
+func (b *circuitBreaker) trip() {
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+	breakerTrips.Inc()
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	breakerStateGauge.Set(float64(s))
+}
+
+// retryAfter returns how long until an open breaker lets a probe through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.cooldown-time.Since(b.openedAt), 0)
+}
+
+// BreakerStatus is the circuit breaker's state on /debug/hindsight.
+type BreakerStatus struct {
+	Enabled             bool    `json:"enabled"`
+	State               string  `json:"state"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	RetryAfterSeconds   float64 `json:"retry_after_seconds,omitempty"`
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	retryAfter := b.retryAfter()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BreakerStatus{
+		Enabled:             b.threshold > 0,
+		State:               b.state.String(),
+		ConsecutiveFailures: b.failures,
+		RetryAfterSeconds:   retryAfter.Seconds(),
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: 50 * time.Millisecond}
+	down := &http.Response{StatusCode: http.StatusBadGateway}
+	notFound := &http.Response{StatusCode: http.StatusNotFound}
+	refused := errors.New("connection refused")
+
+	// Only consecutive failures count, and a 404 is hindsight answering
+	b.record(down, refused)
+	b.record(notFound, errors.New("not found"))
+	b.record(down, refused)
+	if !b.allow() {
+		t.Fatal("opened after failures that weren't consecutive")
+	}
+	b.record(nil, refused)
+	if b.allow() {
+		t.Fatal("still closed after two consecutive failures")
+	}
+	if d := b.retryAfter(); d <= 0 || d > b.cooldown {
+		t.Errorf("retryAfter = %v, want within the cooldown", d)
+	}
+
+	// After the cooldown one probe goes through; its failure reopens
+	time.Sleep(b.cooldown)
+	if !b.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow() {
+		t.Error("a second call went through while probing")
+	}
+	b.record(down, refused)
+	if b.allow() || b.status().State != "open" {
+		t.Fatalf("state = %s after a failed probe, want open", b.status().State)
+	}
+
+	// A canceled probe says nothing, so the next call probes again
+	time.Sleep(b.cooldown)
+	b.allow()
+	b.record(nil, context.Canceled)
+	if !b.allow() {
+		t.Fatal("no new probe after a canceled one")
+	}
+	b.record(nil, nil)
+	if s := b.status(); s.State != "closed" || s.ConsecutiveFailures != 0 {
+		t.Errorf("status = %+v after a successful probe, want closed", s)
+	}
+
+	// A zero threshold disables the breaker
+	b = &circuitBreaker{}
+	for range 10 {
+		b.record(nil, refused)
+	}
+	if !b.allow() {
+		t.Error("disabled breaker opened")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// defaultChunkSize is the chunk_size of a /learn with chunk and none
+	// given, and minChunkSize the smallest allowed. The largest is
+	// maxContentChars.
+	defaultChunkSize = 2000
+	minChunkSize     = 100
+)
+
+// validChunkSize resolves a /learn chunk_size, 0 meaning the default.
+func validChunkSize(n int) (int, error) {
+	if n == 0 {
+		return min(defaultChunkSize, maxContentChars), nil
+	}
+	if n < minChunkSize || n > maxContentChars {
+		return 0, fmt.Errorf("chunk_size must be between %d and %d", minChunkSize, maxContentChars)
+	}
+	return n, nil
+}
+
+var paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+
+// chunkText splits text into chunks of at most size characters, packing
+// whole paragraphs where they fit. A paragraph too long for a chunk is split
+// into sentences, and a sentence too long into words; only a word longer
+// than size is cut mid-word. Whitespace between pieces is normalized: a
+// blank line between paragraphs, a space between sentences.
+func chunkText(text string, size int) []string {
+	var chunks []string
+	var cur strings.Builder
+	curLen := 0
+	add := func(piece, sep string) {
+		n := utf8.RuneCountInString(piece)
+		if curLen > 0 && curLen+len(sep)+n > size {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+			curLen = 0
+		}
+		if curLen > 0 {
+			cur.WriteString(sep)
+			curLen += len(sep)
+		}
+		cur.WriteString(piece)
+		curLen += n
+	}
+
+	for _, para := range paragraphBreak.Split(text, -1) {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		sep := "\n\n"
+		for _, piece := range splitToFit(para, size) {
+			add(piece, sep)
+			sep = " "
+		}
+	}
+	if curLen > 0 {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// splitToFit returns para whole if it fits in size, or else its sentences,
+// words and, for words too long, runs of size characters, in order.
+func splitToFit(para string, size int) []string {
+	if utf8.RuneCountInString(para) <= size {
+		return []string{para}
+	}
+	var out []string
+	for _, sentence := range splitSentences(para) {
+		if utf8.RuneCountInString(sentence) <= size {
+			out = append(out, sentence)
+			continue
+		}
+		for _, word := range strings.Fields(sentence) {
+			for utf8.RuneCountInString(word) > size {
+				cut := runeOffset(word, size)
+				out = append(out, word[:cut])
+				word = word[cut:]
+			}
+			out = append(out, word)
+		}
+	}
+	return out
+}
+
+// splitSentences splits text after each '.', '!' or '?' that is followed
+// by whitespace, trimming the sentences.
+func splitSentences(text string) []string {
+	var out []string
+	start := 0
+	runes := []rune(text)
+	for i, r := range runes {
+		if (r == '.' || r == '!' || r == '?') && i+1 < len(runes) && unicode.IsSpace(runes[i+1]) {
+			if s := strings.TrimSpace(string(runes[start : i+1])); s != "" {
+				out = append(out, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(string(runes[start:])); s != "" {
+		out = append(out, s)
+	}
+	return out
+}
+
+// runeOffset returns the byte offset of the nth rune of s.
+func runeOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{
+			name: "fits whole",
+			text: "  One paragraph.  ",
+			size: 100,
+			want: []string{"One paragraph."},
+		},
+		{
+			name: "paragraphs packed",
+			text: "First para.\n\nSecond para.\n  \nThird para.",
+			size: 30,
+			want: []string{"First para.\n\nSecond para.", "Third para."},
+		},
+		{
+			name: "long paragraph split into sentences",
+			text: "Alice moved to Berlin. She works at Acme! Is she happy? Yes.",
+			size: 25,
+			want: []string{"Alice moved to Berlin.", "She works at Acme!", "Is she happy? Yes."},
+		},
+		{
+			name: "decimal points stay",
+			text: "Version 1.2 shipped today. It is fast.",
+			size: 30,
+			want: []string{"Version 1.2 shipped today.", "It is fast."},
+		},
+		{
+			name: "long word cut",
+			text: strings.Repeat("é", 25),
+			size: 10,
+			want: []string{strings.Repeat("é", 10), strings.Repeat("é", 10), strings.Repeat("é", 5)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkText(tt.text, tt.size)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("chunkText = %q, want %q", got, tt.want)
+			}
+			for _, chunk := range got {
+				if n := utf8.RuneCountInString(chunk); n > tt.size {
+					t.Errorf("chunk %q is %d characters, over %d", chunk, n, tt.size)
+				}
+			}
+		})
+	}
+}
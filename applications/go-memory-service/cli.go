@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// runCommand runs a one-off CLI subcommand and returns the process exit
+// code: 0 on success, 1 if the command failed and 2 on a usage error.
+func (s *Service) runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "learn":
+		err = s.cmdLearn(args)
+	case "recall":
+		err = s.cmdRecall(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\nusage: go-memory-service [learn|recall] [flags]\n", name)
+		return 2
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// cmdLearn retains one piece of content for a user, creating the bank if
+// needed, and prints the result as JSON.
+func (s *Service) cmdLearn(args []string) error {
+	fs := flag.NewFlagSet("learn", flag.ContinueOnError)
+	user := fs.String("user", "", "user ID (required)")
+	tenant := fs.String("tenant", "", "tenant the user belongs to, as X-Tenant-ID")
+	content := fs.String("content", "", "content to store (required)")
+	tags := fs.String("tags", "", "comma-separated tags")
+	memContext := fs.String("context", "", "provenance context for the memory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *content == "" {
+		return errors.New("learn: --content is required")
+	}
+
+	// Tags get the checks /learn gives them, reserved expiry tags included
+	itemTags, err := normalizeTags(splitList(*tags))
+	if err != nil {
+		return fmt.Errorf("learn: %w", err)
+	}
+	bankID, err := bankFor(*tenant, *user)
+	if err != nil {
+		return fmt.Errorf("learn: %w", err)
+	}
+
+	ctx := context.Background()
+	s.ensureBank(ctx, bankID, *user)
+
+	item := hindsight.MemoryItem{Content: *content, Tags: withDefaultTags(itemTags, nil)}
+	if *memContext != "" {
+		item.Context = *hindsight.NewNullableString(memContext)
+	}
+	retainReq := hindsight.RetainRequest{Items: []hindsight.MemoryItem{item}}
+	_, httpResp, err := s.api.Retain(ctx, bankID, retainReq)
+	if err != nil {
+		return fmt.Errorf("learn: %w", err)
+	}
+	httpResp.Body.Close()
+
+	return printJSON(map[string]any{
+		"success":  true,
+		"bank_id":  bankID,
+		"retained": 1,
+	})
+}
+
+// cmdRecall recalls a user's memories for a query and prints them as JSON.
+func (s *Service) cmdRecall(args []string) error {
+	fs := flag.NewFlagSet("recall", flag.ContinueOnError)
+	user := fs.String("user", "", "user ID (required)")
+	tenant := fs.String("tenant", "", "tenant the user belongs to, as X-Tenant-ID")
+	query := fs.String("query", defaultRecallQuery, "recall query")
+	budget := fs.String("budget", "high", "recall budget: low, mid or high")
+	tags := fs.String("tags", "", "comma-separated tags; only memories with any of them are returned")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	bankID, err := bankFor(*tenant, *user)
+	if err != nil {
+		return fmt.Errorf("recall: %w", err)
+	}
+	b, err := parseBudget(*budget)
+	if err != nil {
+		return fmt.Errorf("recall: %w", err)
+	}
+
+	recallReq := hindsight.RecallRequest{
+		Query:  strings.TrimSpace(*query),
+		Budget: b.Ptr(),
+	}
+	if tagList := splitList(*tags); len(tagList) > 0 {
+		recallReq.Tags = tagList
+		recallReq.TagsMatch = hindsight.PtrString("any_strict")
+	}
+
+	ctx := context.Background()
+	resp, httpResp, err := s.api.Recall(ctx, bankID, recallReq)
+	if err != nil {
+		return fmt.Errorf("recall: %w", err)
+	}
+	httpResp.Body.Close()
+	rankByImportance(resp.Results)
+
+	results := []RecallFact{}
+	for _, result := range resp.Results {
+		results = append(results, newRecallFact(result))
+	}
+	return printJSON(RecallResponse{Results: results, Total: len(results)})
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from three layers: environment variables override the
+// CONFIG_FILE, which overrides the code defaults. The file is a flat YAML
+// or JSON object keyed by the same names as the environment variables.
+var (
+	fileSettings map[string]string
+
+	// usedSettings records the effective value of every setting read, for
+	// logSettings; secrets are redacted
+	settingsMu   sync.Mutex
+	usedSettings = map[string]string{}
+)
+
+// secretSettings are never logged.
+var secretSettings = []string{"HINDSIGHT_API_KEY", "SERVICE_AUTH_TOKEN"}
+
+// loadConfigFile reads settings from path. Files ending in .yaml or .yml are
+// parsed as YAML, anything else as JSON. Values may be strings, numbers or
+// booleans.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	fileSettings = make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v := v.(type) {
+		case float64:
+			// JSON numbers are float64, which fmt.Sprint would print as
+			// 1e+06 from a million on
+			fileSettings[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case string, bool, int, int64, uint64:
+			fileSettings[key] = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("config file %s: %s must be a string, number or boolean", path, key)
+		}
+	}
+	return nil
+}
+
+// setting returns the raw value of key from the environment or, failing
+// that, the config file. Empty means unset.
+func setting(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fileSettings[key]
+}
+
+// noteSetting records the effective value of key for logSettings.
+func noteSetting(key string, value any) {
+	v := fmt.Sprint(value)
+	if slices.Contains(secretSettings, key) && v != "" {
+		v = "[redacted]"
+	}
+	settingsMu.Lock()
+	usedSettings[key] = v
+	settingsMu.Unlock()
+}
+
+// SettingValue is the effective value of a setting on /debug/config, and
+// where it came from: "env", "file" (CONFIG_FILE) or "default".
+type SettingValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// settingsSnapshot returns every setting read so far, redacted like
+// logSettings.
+func settingsSnapshot() map[string]SettingValue {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	out := make(map[string]SettingValue, len(usedSettings))
+	for key, v := range usedSettings {
+		source := "default"
+		if os.Getenv(key) != "" {
+			source = "env"
+		} else if fileSettings[key] != "" {
+			source = "file"
+		}
+		out[key] = SettingValue{Value: v, Source: source}
+	}
+	return out
+}
+
+// warnUnknownSettings logs config file settings that nothing read, which
+// are most likely typos.
+func warnUnknownSettings() {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	var unknown []string
+	for key := range fileSettings {
+		if _, ok := usedSettings[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		slog.Warn("ignoring unknown settings in CONFIG_FILE", "settings", strings.Join(unknown, ", "))
+	}
+}
+
+// logSettings logs the effective value of every setting read so far.
+func logSettings() {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	keys := make([]string, 0, len(usedSettings))
+	for key := range usedSettings {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		slog.Info("config", "setting", key, "value", usedSettings[key])
+	}
+}
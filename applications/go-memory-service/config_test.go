@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigLayers(t *testing.T) {
+	t.Cleanup(func() { fileSettings = nil })
+
+	files := map[string]string{
+		"config.yaml": "ASK_TIMEOUT: 20s\nRATE_LIMIT_BURST: 5\nMAX_BODY_BYTES: 1048576\nASK_STORE_INTERACTIONS: false\n",
+		"config.json": `{"ASK_TIMEOUT": "20s", "RATE_LIMIT_BURST": 5, "MAX_BODY_BYTES": 1048576, "ASK_STORE_INTERACTIONS": false}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfigFile(path); err != nil {
+				t.Fatal(err)
+			}
+
+			// File values override defaults
+			if got := envInt("RATE_LIMIT_BURST", 20); got != 5 {
+				t.Errorf("RATE_LIMIT_BURST = %d, want 5 from the file", got)
+			}
+			if got := envInt("MAX_BODY_BYTES", 0); got != 1048576 {
+				t.Errorf("MAX_BODY_BYTES = %d, want 1048576 from the file", got)
+			}
+			if got := envBool("ASK_STORE_INTERACTIONS", true); got {
+				t.Error("ASK_STORE_INTERACTIONS = true, want false from the file")
+			}
+			if got := envDuration("RECALL_TIMEOUT", 30*time.Second); got != 30*time.Second {
+				t.Errorf("RECALL_TIMEOUT = %s, want the 30s default", got)
+			}
+
+			// Environment variables override the file
+			t.Setenv("ASK_TIMEOUT", "5s")
+			if got := envDuration("ASK_TIMEOUT", time.Minute); got != 5*time.Second {
+				t.Errorf("ASK_TIMEOUT = %s, want 5s from the environment", got)
+			}
+		})
+	}
+}
+
+func TestNoteSettingRedactsSecrets(t *testing.T) {
+	noteSetting("HINDSIGHT_API_KEY", "sk-123")
+	settingsMu.Lock()
+	got := usedSettings["HINDSIGHT_API_KEY"]
+	settingsMu.Unlock()
+	if got != "[redacted]" {
+		t.Errorf("logged HINDSIGHT_API_KEY = %q, want it redacted", got)
+	}
+}
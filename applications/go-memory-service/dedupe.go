@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// dedupeCache remembers hashes of content recently retained through /learn,
+// so learning the same content again within window is skipped instead of
+// adding duplicate memories. It holds at most size hashes, evicting the
+// oldest when full. A zero window disables it.
+//
+// It only knows what this process retained: content stored through another
+// replica, /import or an earlier run is not recognized.
+type dedupeCache struct {
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	entries map[dedupeKey]time.Time // expiry
+}
+
+type dedupeKey struct {
+	bankID string
+	hash   [sha256.Size]byte
+}
+
+func newDedupeCache(window time.Duration, size int) *dedupeCache {
+	return &dedupeCache{window: window, size: size, entries: make(map[dedupeKey]time.Time)}
+}
+
+func (c *dedupeCache) enabled() bool {
+	return c.window > 0 && c.size > 0
+}
+
+// seen reports whether content was retained into bankID within the window.
+func (c *dedupeCache) seen(bankID, content string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[dedupeKey{bankID, sha256.Sum256([]byte(content))}]
+	return ok && time.Now().Before(expires)
+}
+
+// add records that contents were retained into bankID.
+func (c *dedupeCache) add(bankID string, contents []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, expires := range c.entries {
+		if now.After(expires) {
+			delete(c.entries, k)
+		}
+	}
+	for _, content := range contents {
+		key := dedupeKey{bankID, sha256.Sum256([]byte(content))}
+		if _, ok := c.entries[key]; !ok {
+			for len(c.entries) >= c.size {
+				c.evictOldest()
+			}
+		}
+		c.entries[key] = now.Add(c.window)
+	}
+}
+
+// forget drops every hash for bankID, for when its memories are deleted and
+// the same content should be storable again.
+func (c *dedupeCache) forget(bankID string) {
+	if !c.enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.entries {
+		if k.bankID == bankID {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// clear drops every hash and returns how many there were.
+func (c *dedupeCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
+
+func (c *dedupeCache) evictOldest() {
+	var oldest dedupeKey
+	var oldestExpires time.Time
+	first := true
+	for k, expires := range c.entries {
+		if first || expires.Before(oldestExpires) {
+			oldest, oldestExpires, first = k, expires, false
+		}
+	}
+	delete(c.entries, oldest)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// ErrorResponse is the JSON body of every error this service returns.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes a structured JSON error with a stable, machine-readable
+// code callers can branch on.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSONBody(w, ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// callError pairs a failed hindsight call's error with its HTTP response,
+// so it can be mapped to a status after crossing a goroutine boundary.
+type callError struct {
+	httpResp *http.Response
+	err      error
+}
+
+func (e *callError) Error() string { return e.err.Error() }
+func (e *callError) Unwrap() error { return e.err }
+
+// splitCallError returns the response and error of the *callError in err's
+// chain, or no response and err itself if there is none, as for errors
+// raised before any call was made.
+func splitCallError(err error) (*http.Response, error) {
+	var ce *callError
+	if errors.As(err, &ce) {
+		return ce.httpResp, ce.err
+	}
+	return nil, err
+}
+
+// errBankUnavailable reports a bank that hindsight still doesn't know after
+// the service tried to create it again.
+var errBankUnavailable = errors.New("memory bank could not be created")
+
+// isBankNotFound reports whether err is a *callError for a hindsight 404,
+// which recall and reflect return for a bank that doesn't exist.
+func isBankNotFound(err error) bool {
+	var ce *callError
+	return errors.As(err, &ce) && ce.httpResp != nil && ce.httpResp.StatusCode == http.StatusNotFound
+}
+
+// writeHindsightError maps a failed hindsight call to an error response.
+func writeHindsightError(w http.ResponseWriter, httpResp *http.Response, err error) {
+	status, detail := hindsightError(httpResp, err)
+	// Pass hindsight's backoff hint on so callers wait as long as it asked
+	if status == http.StatusTooManyRequests && httpResp != nil {
+		if retryAfter := httpResp.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+	}
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(breaker.retryAfter().Seconds()))))
+	}
+	writeError(w, status, detail.Code, detail.Message)
+}
+
+// hindsightError maps a failed hindsight call to an HTTP status and error
+// detail. The raw client error, which can contain backend internals, is
+// never returned; execute has already logged it.
+func hindsightError(httpResp *http.Response, err error) (int, ErrorDetail) {
+	switch {
+	case httpResp != nil && httpResp.StatusCode == http.StatusNotFound:
+		return http.StatusNotFound, ErrorDetail{"bank_not_found", "memory bank not found"}
+	case httpResp != nil && (httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden):
+		// Our credentials, not the caller's, were rejected
+		return http.StatusBadGateway, ErrorDetail{"upstream_unauthorized", "hindsight rejected this service's credentials, check HINDSIGHT_API_KEY"}
+	case httpResp != nil && httpResp.StatusCode == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, ErrorDetail{"upstream_rate_limited", "hindsight is rate limiting requests, retry later"}
+	case httpResp != nil && (httpResp.StatusCode == http.StatusBadRequest || httpResp.StatusCode == http.StatusUnprocessableEntity):
+		return http.StatusBadRequest, ErrorDetail{"invalid_request", "hindsight rejected the request"}
+	case httpResp != nil:
+		return http.StatusBadGateway, ErrorDetail{"upstream_error", "hindsight request failed"}
+	case errors.Is(err, errBankUnavailable):
+		return http.StatusBadGateway, ErrorDetail{"bank_unavailable", "the memory bank is missing in hindsight and could not be created, retry later"}
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, ErrorDetail{"upstream_circuit_open", "hindsight has been failing, so calls are paused briefly; retry later"}
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, ErrorDetail{"overloaded", "too many requests to hindsight in flight, retry later"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, ErrorDetail{"upstream_timeout", "hindsight did not respond in time"}
+	default:
+		return http.StatusBadGateway, ErrorDetail{"upstream_unavailable", "hindsight is unreachable"}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// expandQueries turns on query expansion for /ask and /recall
+// (EXPAND_QUERY).
+var expandQueries = false
+
+const (
+	// expandMaxWords is the longest query that is expanded; longer ones
+	// already give recall enough to work with
+	expandMaxWords = 5
+	// expandMaxChars caps the reformulation reflect returns
+	expandMaxChars = 200
+)
+
+const expandPrompt = "Rewrite this search query to find relevant memories: add synonyms and closely related terms. " +
+	"Reply with the rewritten query only, on one line, with no explanation.\n\nQuery: %s"
+
+// expandQuery returns query followed by a reformulation from a low-budget
+// reflect call, so short queries give recall more terms to match. Long
+// queries, and any query when expansion is off or reflect fails, are
+// returned unchanged.
+func (s *Service) expandQuery(ctx context.Context, bankID, query string) string {
+	if !expandQueries || len(strings.Fields(query)) > expandMaxWords {
+		return query
+	}
+
+	resp, httpResp, err := s.api.Reflect(ctx, bankID, hindsight.ReflectRequest{
+		Query:  fmt.Sprintf(expandPrompt, query),
+		Budget: hindsight.LOW.Ptr(),
+	})
+	if err != nil {
+		slog.DebugContext(ctx, "query expansion failed, using the original query", "error", err)
+		return query
+	}
+	httpResp.Body.Close()
+
+	extra, _, _ := strings.Cut(strings.TrimSpace(resp.GetText()), "\n")
+	extra = strings.Trim(strings.TrimSpace(extra), `"'`)
+	if r := []rune(extra); len(r) > expandMaxChars {
+		extra = string(r[:expandMaxChars])
+	}
+	if extra == "" || strings.EqualFold(extra, query) {
+		return query
+	}
+	return query + " " + extra
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hindsight has no native expiry for memories, so a /learn with a TTL tags
+// its memories with expiryTagPrefix and the Unix time they expire, and
+// sweepExpired deletes them once that time has passed. Until the next sweep
+// an expired memory can still be recalled.
+const expiryTagPrefix = "expires:"
+
+// learnExpiry resolves a /learn request's ttl_seconds or expires_at to the
+// time its memories expire, or the zero time for memories that don't.
+func learnExpiry(ttlSeconds int64, expiresAt string, now time.Time) (time.Time, error) {
+	switch {
+	case ttlSeconds != 0 && expiresAt != "":
+		return time.Time{}, errors.New("set ttl_seconds or expires_at, not both")
+	case ttlSeconds < 0:
+		return time.Time{}, errors.New("ttl_seconds must be positive")
+	case ttlSeconds > 0:
+		return now.Add(time.Duration(ttlSeconds) * time.Second), nil
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return time.Time{}, errors.New("expires_at must be an RFC 3339 time")
+		}
+		if !t.After(now) {
+			return time.Time{}, errors.New("expires_at is in the past")
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// checkReservedTags rejects tags starting with expiryTagPrefix, which only
+// the service may set: the sweep would delete memories tagged that way.
+func checkReservedTags(tags []string) error {
+	for _, tag := range tags {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(tag)), expiryTagPrefix) {
+			return fmt.Errorf("tag %q is reserved: tags starting with %q mark expiry, set with ttl_seconds or expires_at", tag, expiryTagPrefix)
+		}
+	}
+	return nil
+}
+
+func expiryTag(t time.Time) string {
+	return expiryTagPrefix + strconv.FormatInt(t.Unix(), 10)
+}
+
+// memoryExpiry returns the expiry recorded in a memory's tags.
+func memoryExpiry(tags []string) (time.Time, bool) {
+	for _, tag := range tags {
+		if v, ok := strings.CutPrefix(tag, expiryTagPrefix); ok {
+			if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(sec, 0), true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// sweepExpired deletes expired memories from this service's banks, those
+// starting with bankPrefix, each interval. It returns when ctx is done.
+func (s *Service) sweepExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sweepOnce(ctx, now)
+		}
+	}
+}
+
+// sweepOnce runs one pass of sweepExpired. A bank that fails is logged and
+// left for the next pass.
+func (s *Service) sweepOnce(ctx context.Context, now time.Time) {
+	resp, httpResp, err := s.api.ListBanks(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "listing banks for the expiry sweep failed", "error", err)
+		return
+	}
+	httpResp.Body.Close()
+
+	for _, b := range resp.GetBanks() {
+		bankID := b.GetBankId()
+		// Banks of other deployments sharing hindsight are theirs to sweep
+		if !strings.HasPrefix(bankID, bankPrefix) {
+			continue
+		}
+		n, err := s.sweepBank(ctx, bankID, now)
+		if n > 0 {
+			slog.InfoContext(ctx, "deleted expired memories", "bank_id", bankID, "count", n)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.WarnContext(ctx, "expiry sweep failed", "bank_id", bankID, "error", err)
+		}
+	}
+}
+
+// sweepBank deletes the memories of bankID that expired by now and returns
+// how many it deleted.
+func (s *Service) sweepBank(ctx context.Context, bankID string, now time.Time) (int, error) {
+	var ids []string
+	_, err := s.listMemories(ctx, bankID, func(items []map[string]any) error {
+		for _, item := range items {
+			id, _ := item["id"].(string)
+			if expires, ok := memoryExpiry(stringList(item["tags"])); ok && id != "" && !expires.After(now) {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		var httpResp *http.Response
+		_, httpResp, err = s.api.DeleteMemory(ctx, bankID, id)
+		if err != nil {
+			break
+		}
+		httpResp.Body.Close()
+		deleted++
+	}
+	if deleted > 0 {
+		s.answers.invalidate(bankID)
+		s.stats.forget(bankID)
+		s.recent.forget(bankID)
+	}
+	return deleted, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failoverTransport spreads hindsight calls over several equivalent
+// servers. Requests are built against the first server's URL; the transport
+// rewrites them to whichever server it picks. A server that fails to
+// connect or answers 5xx is skipped for cooldown. The request itself only
+// moves on to the next server if sending it again is safe: its method is
+// idempotent, or the connection failed before anything was sent. So a
+// retain (a POST) that may have been stored is never written twice. This
+// is independent of execute's retries, which repeat a call against the
+// same endpoint.
+type failoverTransport struct {
+	base     http.RoundTripper
+	primary  *url.URL
+	servers  []*backendServer
+	cooldown time.Duration
+}
+
+type backendServer struct {
+	url *url.URL
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (s *backendServer) healthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.downUntil)
+}
+
+func (s *backendServer) markDown(until time.Time) {
+	s.mu.Lock()
+	s.downUntil = until
+	s.mu.Unlock()
+}
+
+func newFailoverTransport(base http.RoundTripper, serverURLs []string, cooldown time.Duration) (*failoverTransport, error) {
+	t := &failoverTransport{base: base, cooldown: cooldown}
+	for _, raw := range serverURLs {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid hindsight server URL %q", raw)
+		}
+		t.servers = append(t.servers, &backendServer{url: u})
+	}
+	t.primary = t.servers[0].url
+	return t, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	candidates := t.candidates(time.Now())
+
+	var resp *http.Response
+	var err error
+	for i, s := range candidates {
+		attempt := req.Clone(req.Context())
+		attempt.URL = t.rewrite(req.URL, s.url)
+		attempt.Host = ""
+		if i > 0 && hasBody(req) {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = t.base.RoundTrip(attempt)
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if !failed || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		s.markDown(time.Now().Add(t.cooldown))
+		slog.WarnContext(req.Context(), "hindsight server failed, skipping it", "server", s.url.Host, "cooldown", t.cooldown)
+		if i == len(candidates)-1 || !canResend(req, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+// canResend reports whether req, which failed with err, may be sent to
+// another server: its body can be replayed, and either its method is
+// idempotent or err shows it never reached the server.
+func canResend(req *http.Request, err error) bool {
+	if hasBody(req) && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return err != nil && dialFailed(err)
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// candidates orders servers for one request: healthy ones first, in
+// configured order, then those cooling down as a last resort.
+func (t *failoverTransport) candidates(now time.Time) []*backendServer {
+	var healthy, down []*backendServer
+	for _, s := range t.servers {
+		if s.healthy(now) {
+			healthy = append(healthy, s)
+		} else {
+			down = append(down, s)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// rewrite moves u from the primary server onto target, keeping the path
+// below the server's base path plus the query.
+func (t *failoverTransport) rewrite(u, target *url.URL) *url.URL {
+	out := *u
+	out.Scheme = target.Scheme
+	out.Host = target.Host
+	rest := strings.TrimPrefix(u.Path, strings.TrimSuffix(t.primary.Path, "/"))
+	out.Path = strings.TrimSuffix(target.Path, "/") + rest
+	out.RawPath = ""
+	return &out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailoverTransport(t *testing.T) {
+	var downHits atomic.Int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.URL.Path+" "+string(body))
+	}))
+	defer up.Close()
+
+	ft, err := newFailoverTransport(http.DefaultTransport, []string{down.URL, up.URL}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: ft}
+	send := func(method string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, down.URL+"/v1/default/banks/b/memories", strings.NewReader(`{"q":1}`))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		got, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(got)
+	}
+	want := `/v1/default/banks/b/memories {"q":1}`
+
+	// A POST that reached a failing server may have been applied, so it
+	// isn't sent again; the server is skipped from then on
+	if status, _ := send("POST"); status != http.StatusServiceUnavailable {
+		t.Errorf("first POST: got %d, want the 503", status)
+	}
+	if status, got := send("POST"); status != http.StatusOK || got != want {
+		t.Errorf("second POST: got %d %q, want 200 %q", status, got, want)
+	}
+	if n := downHits.Load(); n != 1 {
+		t.Errorf("failed server hit %d times, want 1", n)
+	}
+
+	// Idempotent requests move on to the next server
+	ft.servers[0].markDown(time.Time{})
+	if status, got := send("PUT"); status != http.StatusOK || got != want {
+		t.Errorf("PUT: got %d %q, want 200 %q", status, got, want)
+	}
+	if n := downHits.Load(); n != 2 {
+		t.Errorf("failed server hit %d times, want 2", n)
+	}
+
+	// So does a POST whose server refused the connection
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	ft, err = newFailoverTransport(http.DefaultTransport, []string{closed.URL, up.URL}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Transport = ft
+	req, _ := http.NewRequest("POST", closed.URL+"/v1/x", strings.NewReader("body"))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != "/v1/x body" {
+		t.Errorf("POST after a refused connection: got %q, want it sent to the next server", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// fakeAPI is an in-memory hindsightAPI that records the requests it is
+// sent. Setting status makes every memory call and Version fail with that HTTP status
+// (with "Retry-After: 7" for a 429). With bankMissing, recall and reflect
+// fail with a 404 until the bank is created, and createFails bank creations
+// fail before one succeeds.
+type fakeAPI struct {
+	mu       sync.Mutex
+	retains  []hindsight.RetainRequest
+	recalls  []hindsight.RecallRequest
+	reflects []hindsight.ReflectRequest
+	banks    []hindsight.CreateBankRequest
+	deleted  []string // bank IDs
+	forgot   []string // memory IDs
+
+	results  []hindsight.RecallResult
+	memories []map[string]any // listed by ListMemories
+	// bankMemories, if set, are listed instead for the banks it has
+	bankMemories map[string][]map[string]any
+	bankList     []hindsight.BankListItem // returned by ListBanks
+	answer       string
+	basedOn      []hindsight.ReflectFact // returned when a reflect asks for facts
+	status       int
+	bankMissing  bool
+	createFails  int
+	// dropItems is how many items of each retain are reported as not stored
+	dropItems int
+}
+
+func ok() *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}
+}
+
+func notFound() *http.Response {
+	return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}
+}
+
+func (f *fakeAPI) fail() (*http.Response, error) {
+	if f.status == 0 {
+		return nil, nil
+	}
+	httpResp := &http.Response{StatusCode: f.status, Header: http.Header{}, Body: http.NoBody}
+	if f.status == http.StatusTooManyRequests {
+		httpResp.Header.Set("Retry-After", "7")
+	}
+	return httpResp, errors.New(http.StatusText(f.status))
+}
+
+func (f *fakeAPI) Retain(ctx context.Context, bankID string, req hindsight.RetainRequest) (*hindsight.RetainResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.retains = append(f.retains, req)
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	return &hindsight.RetainResponse{Success: true, BankId: bankID, ItemsCount: int32(len(req.Items) - f.dropItems)}, ok(), nil
+}
+
+func (f *fakeAPI) Recall(ctx context.Context, bankID string, req hindsight.RecallRequest) (*hindsight.RecallResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recalls = append(f.recalls, req)
+	if f.bankMissing {
+		return nil, notFound(), fmt.Errorf("bank %s not found", bankID)
+	}
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	return &hindsight.RecallResponse{Results: f.results}, ok(), nil
+}
+
+func (f *fakeAPI) Reflect(ctx context.Context, bankID string, req hindsight.ReflectRequest) (*hindsight.ReflectResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reflects = append(f.reflects, req)
+	if f.bankMissing {
+		return nil, notFound(), fmt.Errorf("bank %s not found", bankID)
+	}
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	resp := &hindsight.ReflectResponse{Text: f.answer}
+	if req.Include != nil && req.Include.Facts != nil {
+		resp.BasedOn = f.basedOn
+	}
+	return resp, ok(), nil
+}
+
+func (f *fakeAPI) ListMemories(ctx context.Context, bankID string, limit, offset int32) (*hindsight.ListMemoryUnitsResponse, *http.Response, error) {
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	memories := f.memories
+	if m, ok := f.bankMemories[bankID]; ok {
+		memories = m
+	}
+	start := min(int(offset), len(memories))
+	end := min(start+int(limit), len(memories))
+	return &hindsight.ListMemoryUnitsResponse{Items: memories[start:end]}, ok(), nil
+}
+
+func (f *fakeAPI) ClearMemories(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	return &hindsight.DeleteResponse{}, ok(), nil
+}
+
+func (f *fakeAPI) DeleteMemory(ctx context.Context, bankID, memoryID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forgot = append(f.forgot, memoryID)
+	return &hindsight.DeleteResponse{}, ok(), nil
+}
+
+func (f *fakeAPI) CreateOrUpdateBank(ctx context.Context, bankID string, req hindsight.CreateBankRequest) (*hindsight.BankProfileResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.banks = append(f.banks, req)
+	if f.createFails > 0 {
+		f.createFails--
+		return nil, &http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody}, errors.New("create failed")
+	}
+	f.bankMissing = false
+	profile := &hindsight.BankProfileResponse{BankId: bankID}
+	if name := req.Name.Get(); name != nil {
+		profile.Name = *name
+	}
+	if mission := req.Mission.Get(); mission != nil {
+		profile.Mission = *mission
+	}
+	return profile, ok(), nil
+}
+
+func (f *fakeAPI) GetBankProfile(ctx context.Context, bankID string) (*hindsight.BankProfileResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bankMissing {
+		return nil, notFound(), fmt.Errorf("bank %s not found", bankID)
+	}
+	return &hindsight.BankProfileResponse{}, ok(), nil
+}
+
+func (f *fakeAPI) ListBanks(ctx context.Context) (*hindsight.BankListResponse, *http.Response, error) {
+	return &hindsight.BankListResponse{Banks: f.bankList}, ok(), nil
+}
+
+func (f *fakeAPI) DeleteBank(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, bankID)
+	return &hindsight.DeleteResponse{}, ok(), nil
+}
+
+func (f *fakeAPI) Version(ctx context.Context) (*hindsight.VersionResponse, *http.Response, error) {
+	if httpResp, err := f.fail(); err != nil {
+		return nil, httpResp, err
+	}
+	return &hindsight.VersionResponse{}, ok(), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body worth compressing.
+const gzipMinSize = 1024
+
+// withGzip compresses responses for clients that accept gzip. The first
+// gzipMinSize bytes are held back to decide: smaller bodies, bodies the
+// handler already encoded and flushed responses that haven't reached the
+// threshold are sent as is. Larger bodies are compressed as they are
+// written, so streamed responses like /export are never buffered whole.
+// Server-Sent Events are never compressed.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wantsEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header admits gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err != nil || v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter decides on compression once the body reaches gzipMinSize,
+// the handler flushes or the handler returns, whichever comes first.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte       // body held back until the decision
+	gz     *gzip.Writer // set once compressing
+	plain  bool         // set once sending uncompressed
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(p)
+	case w.plain:
+		return w.ResponseWriter.Write(p)
+	}
+
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		if err := w.startPlain(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// FlushError is used by http.ResponseController. A flush before the
+// threshold commits to an uncompressed response, since the handler wants
+// the bytes on the wire now.
+func (w *gzipWriter) FlushError() error {
+	switch {
+	case w.gz != nil:
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	case !w.plain:
+		if err := w.startPlain(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) startGzip() error {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	w.writeHeader()
+
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipWriter) startPlain() error {
+	w.plain = true
+	w.writeHeader()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipWriter) writeHeader() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// close sends whatever is still held back and ends the gzip stream.
+func (w *gzipWriter) close() {
+	switch {
+	case w.gz != nil:
+		w.gz.Close()
+	case !w.plain:
+		w.startPlain()
+	}
+}
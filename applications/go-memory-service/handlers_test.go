@@ -0,0 +1,1662 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+func TestHandleLearn(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		status     int // hindsight failure status, 0 for success
+		dropItems  int
+		wantStatus int
+		wantCode   string
+		check      func(t *testing.T, f *fakeAPI, resp map[string]any)
+	}{
+		{
+			name:       "single content",
+			body:       `{"user_id": "alice", "content": "I use Go", "tags": ["project"], "context": "onboarding"}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp map[string]any) {
+				if len(f.retains) != 1 || len(f.retains[0].Items) != 1 {
+					t.Fatalf("retains = %+v, want one request with one item", f.retains)
+				}
+				item := f.retains[0].Items[0]
+				if item.Content != "I use Go" || !slices.Equal(item.Tags, []string{"project"}) || item.Context.Get() == nil || *item.Context.Get() != "onboarding" {
+					t.Errorf("retained item = %+v", item)
+				}
+				if len(f.banks) != 0 {
+					t.Errorf("existing bank was updated: %+v", f.banks)
+				}
+			},
+		},
+		{
+			name:       "bulk items",
+			body:       `{"user_id": "alice", "items": [{"content": "a"}, {"content": "b", "tags": ["x"]}]}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp map[string]any) {
+				if len(f.retains) != 1 || len(f.retains[0].Items) != 2 {
+					t.Fatalf("retains = %+v, want one request with two items", f.retains)
+				}
+				if _, ok := resp["partial"]; ok {
+					t.Errorf("response = %v, want no partial flag", resp)
+				}
+			},
+		},
+		{
+			name:       "partial retain",
+			body:       `{"user_id": "alice", "items": [{"content": "a"}, {"content": "b"}, {"content": "c"}]}`,
+			dropItems:  1,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp map[string]any) {
+				if resp["partial"] != true || resp["retained"] != 2.0 || resp["failed"] != 1.0 {
+					t.Errorf("response = %v, want 2 retained and 1 failed", resp)
+				}
+			},
+		},
+		{
+			name:       "nothing retained",
+			body:       `{"user_id": "alice", "content": "a"}`,
+			dropItems:  1,
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "upstream_error",
+		},
+		{
+			name:       "invalid json",
+			body:       `{"user_id": `,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_json",
+		},
+		{
+			name:       "missing content",
+			body:       `{"user_id": "alice"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "normalized tags",
+			body:       `{"user_id": "alice", "items": [{"content": "a", "tags": ["Go", " go ", "Project"]}]}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp map[string]any) {
+				if got := f.retains[0].Items[0].Tags; !slices.Equal(got, []string{"go", "project"}) {
+					t.Errorf("tags = %q, want trimmed, lower-cased and deduplicated", got)
+				}
+			},
+		},
+		{
+			name:       "empty tag",
+			body:       `{"user_id": "alice", "content": "a", "tags": [""]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "backend error",
+			body:       `{"user_id": "alice", "content": "I use Go"}`,
+			status:     http.StatusInternalServerError,
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "upstream_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{status: tt.status, dropItems: tt.dropItems}
+			w := httptest.NewRecorder()
+			newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(tt.body)))
+
+			checkResponse(t, w, tt.wantStatus, tt.wantCode)
+			if tt.check != nil {
+				var resp map[string]any
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, f, resp)
+			}
+		})
+	}
+}
+
+func TestDefaultTags(t *testing.T) {
+	defaultTags = []string{"source:webapp", "prod"}
+	defer func() { defaultTags = nil }()
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "merged", body: `{"user_id": "alice", "content": "c", "tags": ["Prod", "editor"]}`, want: []string{"prod", "editor", "source:webapp"}},
+		{name: "no tags", body: `{"user_id": "alice", "content": "c"}`, want: []string{"source:webapp", "prod"}},
+		{name: "opted out", body: `{"user_id": "alice", "content": "c", "tags": ["editor"], "default_tags": false}`, want: []string{"editor"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{}
+			w := httptest.NewRecorder()
+			newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(tt.body)))
+
+			checkResponse(t, w, http.StatusOK, "")
+			if got := f.retains[0].Items[0].Tags; !slices.Equal(got, tt.want) {
+				t.Errorf("tags = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Stored interactions get them after ASK_INTERACTION_TAGS and the request's
+	f := &fakeAPI{answer: "vim"}
+	w := httptest.NewRecorder()
+	newService(f).handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(`{"user_id": "alice", "query": "Which editor?", "tags": ["prod"]}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	background.wg.Wait()
+	if got, want := f.retains[0].Items[0].Tags, []string{"prod", "source:webapp"}; !slices.Equal(got, want) {
+		t.Errorf("interaction tags = %q, want %q", got, want)
+	}
+}
+
+func TestHandleLearnPlainText(t *testing.T) {
+	f := &fakeAPI{}
+	r := httptest.NewRequest("POST", "/learn?user=alice&tags=logs,Deploy&context=journald", strings.NewReader("deploy finished in 42s\n"))
+	r.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	w := httptest.NewRecorder()
+	newService(f).handleLearn(w, r)
+
+	checkResponse(t, w, http.StatusOK, "")
+	if len(f.retains) != 1 || len(f.retains[0].Items) != 1 {
+		t.Fatalf("retains = %+v, want one request with one item", f.retains)
+	}
+	item := f.retains[0].Items[0]
+	if item.Content != "deploy finished in 42s" || !slices.Equal(item.Tags, []string{"logs", "deploy"}) || *item.Context.Get() != "journald" {
+		t.Errorf("retained item = %+v", item)
+	}
+}
+
+func TestLearnIdempotencyKey(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	learn := func(userID, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/learn", strings.NewReader(`{"user_id": "`+userID+`", "content": "I use Go"}`))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		svc.handleLearn(w, r)
+		checkResponse(t, w, http.StatusOK, "")
+		return w
+	}
+
+	first := learn("alice", "k1")
+	replay := learn("alice", "k1")
+	if len(f.retains) != 1 {
+		t.Fatalf("retains = %d, want 1 for a repeated key", len(f.retains))
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %s (headers %v), want the original %s", replay.Body, replay.Header(), first.Body)
+	}
+
+	learn("bob", "k1")
+	learn("alice", "k2")
+	if len(f.retains) != 3 {
+		t.Errorf("retains = %d, want 3: keys are per user", len(f.retains))
+	}
+}
+
+func TestLearnDedupe(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	svc.recent.window = time.Hour
+
+	learn := func(body string) map[string]any {
+		t.Helper()
+		w := httptest.NewRecorder()
+		svc.handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusOK, "")
+		var resp map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := learn(`{"user_id": "alice", "content": "Prefers tabs"}`); resp["skipped_duplicate"] != nil {
+		t.Errorf("first learn: skipped_duplicate = %v", resp["skipped_duplicate"])
+	}
+	resp := learn(`{"user_id": "alice", "content": "Prefers tabs"}`)
+	if resp["skipped_duplicate"] != true || resp["retained"] != 0.0 || len(f.retains) != 1 {
+		t.Errorf("repeat: resp = %v, %d retains, want it skipped", resp, len(f.retains))
+	}
+
+	resp = learn(`{"user_id": "alice", "items": [{"content": "Prefers tabs"}, {"content": "Uses vim"}, {"content": "Uses vim"}]}`)
+	if resp["duplicates"] != 2.0 || len(f.retains) != 2 || len(f.retains[1].Items) != 1 {
+		t.Errorf("bulk: resp = %v, retains = %+v, want only one item stored", resp, f.retains)
+	}
+
+	// Other users, and a user whose bank was deleted, start fresh
+	learn(`{"user_id": "bob", "content": "Prefers tabs"}`)
+	svc.recent.forget("user-alice")
+	learn(`{"user_id": "alice", "content": "Prefers tabs"}`)
+	if len(f.retains) != 4 {
+		t.Errorf("retains = %d, want 4", len(f.retains))
+	}
+}
+
+func TestLearnImportance(t *testing.T) {
+	f := &fakeAPI{}
+	w := httptest.NewRecorder()
+	newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(`{"user_id": "alice", "importance": 4, "items": [{"content": "a"}, {"content": "b", "importance": 5}]}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	items := f.retains[0].Items
+	if items[0].Metadata["importance"] != "4" || items[1].Metadata["importance"] != "5" {
+		t.Errorf("items = %+v, want the request's importance and the item's own", items)
+	}
+
+	for _, body := range []string{
+		`{"user_id": "alice", "content": "x", "importance": 6}`,
+		`{"user_id": "alice", "content": "x", "importance": -1}`,
+	} {
+		w := httptest.NewRecorder()
+		newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusBadRequest, "invalid_request")
+	}
+}
+
+func TestLearnChunk(t *testing.T) {
+	f := &fakeAPI{}
+	long := strings.Repeat("Alice likes long walks on the beach. ", 10)
+	body := `{"user_id": "alice", "content": "` + long + `", "chunk": true, "chunk_size": 100, "tags": ["bio"], "context": "profile"}`
+	w := httptest.NewRecorder()
+	newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(body)))
+	checkResponse(t, w, http.StatusOK, "")
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	items := f.retains[0].Items
+	if len(f.retains) != 1 || len(items) != 5 || resp["chunks"] != 5.0 {
+		t.Fatalf("%d retains of %d items, chunks = %v; want 5 chunks in one retain", len(f.retains), len(items), resp["chunks"])
+	}
+	for _, item := range items {
+		if !slices.Equal(item.Tags, []string{"bio"}) || item.GetContext() != "profile" {
+			t.Errorf("chunk = %+v, want the request's tags and context", item)
+		}
+	}
+
+	for _, body := range []string{
+		`{"user_id": "alice", "content": "x", "chunk": true, "chunk_size": 10}`,
+		`{"user_id": "alice", "content": "x", "chunk_size": 500}`,
+	} {
+		w := httptest.NewRecorder()
+		newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusBadRequest, "invalid_request")
+	}
+}
+
+func TestLearnAsync(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	poll := func(body string) JobResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		svc.handleLearnAsync(w, httptest.NewRequest("POST", "/learn/async", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusAccepted, "")
+		var accepted JobResponse
+		if err := json.NewDecoder(w.Body).Decode(&accepted); err != nil {
+			t.Fatal(err)
+		}
+		if accepted.Status != jobPending || w.Header().Get("Location") != "/jobs/"+accepted.JobID {
+			t.Fatalf("accepted %+v at %q, want a pending job", accepted, w.Header().Get("Location"))
+		}
+		if err := background.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "/jobs/"+accepted.JobID, nil)
+		r.SetPathValue("jobID", accepted.JobID)
+		w = httptest.NewRecorder()
+		handleJob(w, r)
+		checkResponse(t, w, http.StatusOK, "")
+		var job JobResponse
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	job := poll(`{"user_id": "alice", "content": "Alice lives in Berlin"}`)
+	var result map[string]any
+	if err := json.Unmarshal(job.Result, &result); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobDone || job.StatusCode != http.StatusOK || job.FinishedAt == nil || result["retained"] != 1.0 {
+		t.Errorf("job = %+v, want done with the learn's result", job)
+	}
+	if len(f.retains) != 1 || f.retains[0].Items[0].Content != "Alice lives in Berlin" {
+		t.Errorf("retains = %+v, want the content retained", f.retains)
+	}
+
+	job = poll(`{"user_id": "alice"}`)
+	if job.Status != jobFailed || job.StatusCode != http.StatusBadRequest || job.Error == nil || job.Error.Code != "invalid_request" {
+		t.Errorf("job = %+v, want failed with invalid_request", job)
+	}
+
+	r := httptest.NewRequest("GET", "/jobs/nope", nil)
+	r.SetPathValue("jobID", "nope")
+	w := httptest.NewRecorder()
+	handleJob(w, r)
+	checkResponse(t, w, http.StatusNotFound, "job_not_found")
+}
+
+func TestJobQueueFull(t *testing.T) {
+	// Without workers nothing is taken off the queue
+	q := &jobQueue{size: 1, ttl: time.Hour, jobs: make(map[string]*job)}
+	run := func(ctx context.Context, w http.ResponseWriter) { w.Write([]byte("{}")) }
+	id, ok := q.submit(context.Background(), run)
+	if !ok {
+		t.Fatal("first job refused")
+	}
+	if _, ok := q.submit(context.Background(), run); ok {
+		t.Error("job queued past the queue size")
+	}
+	if job, _ := q.get(id); job.Status != jobPending {
+		t.Errorf("status = %s, want pending", job.Status)
+	}
+
+	q.runJob(<-q.queue)
+	if job, _ := q.get(id); job.Status != jobDone || string(job.Result) != "{}" {
+		t.Errorf("job = %+v, want done", job)
+	}
+	q.ttl = 0
+	if _, ok := q.get(id); ok {
+		t.Error("expired job still returned")
+	}
+}
+
+func TestLearnExpiry(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	before := time.Now()
+	w := httptest.NewRecorder()
+	svc.handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(`{"user_id": "alice", "content": "Currently traveling", "tags": ["travel"], "ttl_seconds": 3600}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	tags := f.retains[0].Items[0].Tags
+	expires, ok := memoryExpiry(tags)
+	if !ok || tags[0] != "travel" || expires.Before(before.Add(time.Hour).Truncate(time.Second)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("tags = %v, want travel and an expiry an hour from now", tags)
+	}
+
+	for _, body := range []string{
+		`{"user_id": "alice", "content": "x", "ttl_seconds": -1}`,
+		`{"user_id": "alice", "content": "x", "expires_at": "tomorrow"}`,
+		`{"user_id": "alice", "content": "x", "expires_at": "2020-01-01T00:00:00Z"}`,
+		`{"user_id": "alice", "content": "x", "ttl_seconds": 60, "expires_at": "2099-01-01T00:00:00Z"}`,
+		`{"user_id": "alice", "content": "x", "tags": ["expires:1"]}`,
+	} {
+		w := httptest.NewRecorder()
+		svc.handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusBadRequest, "invalid_request")
+	}
+
+	now := time.Now()
+	f.memories = []map[string]any{
+		{"id": "m1", "tags": []any{"travel", expiryTag(now.Add(-time.Minute))}},
+		{"id": "m2", "tags": []any{expiryTag(now.Add(time.Minute))}},
+		{"id": "m3", "tags": []any{"travel"}},
+	}
+	n, err := svc.sweepBank(context.Background(), "user-alice", now)
+	if err != nil || n != 1 || !slices.Equal(f.forgot, []string{"m1"}) {
+		t.Errorf("sweep deleted %d %v (%v), want only m1", n, f.forgot, err)
+	}
+
+	// Only banks with this service's prefix are swept
+	expired := []map[string]any{{"id": "m4", "tags": []any{expiryTag(now.Add(-time.Minute))}}}
+	f.forgot = nil
+	f.bankList = []hindsight.BankListItem{{BankId: "user-bob"}, {BankId: "other-bob"}}
+	f.bankMemories = map[string][]map[string]any{"user-bob": expired, "other-bob": expired}
+	svc.sweepOnce(context.Background(), now)
+	if !slices.Equal(f.forgot, []string{"m4"}) {
+		t.Errorf("sweep deleted %v, want only user-bob's m4", f.forgot)
+	}
+}
+
+func TestHandleAsk(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		status     int
+		wantStatus int
+		wantCode   string
+		check      func(t *testing.T, f *fakeAPI, resp AskResponse)
+	}{
+		{
+			name:       "defaults",
+			body:       `{"user_id": "alice", "query": "What do I use?"}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				if resp.Answer != "You use Go." || !slices.Equal(resp.Facts, []string{"alice uses Go"}) || resp.Sources != nil {
+					t.Errorf("response = %+v", resp)
+				}
+				recall := f.recalls[0]
+				if recall.Query != "What do I use?" || *recall.Budget != hindsight.MID || *recall.MaxTokens != 2048 {
+					t.Errorf("recall request = %+v, want mid budget and 2048 max tokens", recall)
+				}
+				if c := f.reflects[0].Context.Get(); c == nil || !strings.Contains(*c, "alice uses Go") {
+					t.Errorf("reflect context = %v, want the recalled facts", c)
+				}
+				// The interaction is stored in the background
+				background.wg.Wait()
+				if len(f.retains) != 1 {
+					t.Errorf("retains = %d, want the interaction stored", len(f.retains))
+				}
+			},
+		},
+		{
+			name:       "without facts",
+			url:        "/ask?include_facts=false",
+			body:       `{"user_id": "alice", "query": "What do I use?", "store_interaction": false}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				if resp.Facts != nil || resp.FactCount != 1 || resp.Answer != "You use Go." {
+					t.Errorf("response = %+v, want the answer and count without facts", resp)
+				}
+				if c := f.reflects[0].Context.Get(); c == nil || !strings.Contains(*c, "alice uses Go") {
+					t.Errorf("reflect context = %v, want the recalled facts", c)
+				}
+			},
+		},
+		{
+			name:       "answer language",
+			body:       `{"user_id": "alice", "query": "Which editor?", "lang": "fr", "store_interaction": false}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				if got := f.reflects[0].Query; got != "Answer in French.\n\nWhich editor?" {
+					t.Errorf("reflect query = %q, want the language instruction first", got)
+				}
+				if got := f.recalls[0].Query; got != "Which editor?" {
+					t.Errorf("recall query = %q, want it unchanged", got)
+				}
+			},
+		},
+		{
+			name:       "invalid language",
+			body:       `{"user_id": "alice", "query": "q", "lang": "not a language"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "interaction tags",
+			body:       `{"user_id": "alice", "query": "Which editor?", "tags": ["Editor", " editor "]}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				background.wg.Wait()
+				if len(f.retains) != 1 {
+					t.Fatalf("retains = %d, want the interaction stored", len(f.retains))
+				}
+				item := f.retains[0].Items[0]
+				if !slices.Equal(item.Tags, []string{"editor"}) || *item.Context.Get() != "Q&A interaction" {
+					t.Errorf("stored interaction = %+v, want the request's tags and the default context", item)
+				}
+				if item.Metadata[interactionQueryKey] != "Which editor?" || item.Metadata[interactionAnswerKey] != resp.Answer {
+					t.Errorf("interaction metadata = %v, want the query and answer for /replay", item.Metadata)
+				}
+			},
+		},
+		{
+			name:       "detailed facts",
+			url:        "/ask?detailed=true",
+			body:       `{"user_id": "alice", "query": "q", "store_interaction": false}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				want := []RecallFact{{ID: "m1", Text: "alice uses Go", Type: "unknown", Tags: []string{"project"}, Importance: defaultImportance}}
+				if !reflect.DeepEqual(resp.FactsDetailed, want) || !slices.Equal(resp.Facts, []string{"alice uses Go"}) {
+					t.Errorf("facts = %v, facts_detailed = %+v; want %+v alongside the text", resp.Facts, resp.FactsDetailed, want)
+				}
+			},
+		},
+		{
+			name:       "verbose sources",
+			url:        "/ask?verbose=true",
+			body:       `{"user_id": "alice", "query": "q", "store_interaction": false}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				want := []ReflectSource{{ID: "m1", Text: "alice uses Go"}}
+				if !reflect.DeepEqual(resp.Sources, want) {
+					t.Errorf("sources = %+v, want %+v", resp.Sources, want)
+				}
+			},
+		},
+		{
+			name:       "explicit budget and max tokens",
+			body:       `{"user_id": "alice", "query": "q", "budget": "HIGH", "max_tokens": 512, "store_interaction": false, "reflect_mode": "independent"}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp AskResponse) {
+				recall := f.recalls[0]
+				if *recall.Budget != hindsight.HIGH || *recall.MaxTokens != 512 {
+					t.Errorf("recall request = %+v, want high budget and 512 max tokens", recall)
+				}
+				if *f.reflects[0].Budget != hindsight.HIGH {
+					t.Errorf("reflect budget = %v, want high", *f.reflects[0].Budget)
+				}
+				if f.reflects[0].Context.IsSet() {
+					t.Errorf("reflect context = %q, want none for an independent reflect", *f.reflects[0].Context.Get())
+				}
+				background.wg.Wait()
+				if len(f.retains) != 0 {
+					t.Errorf("retains = %d, want none with store_interaction false", len(f.retains))
+				}
+			},
+		},
+		{
+			name:       "invalid json",
+			body:       `not json`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_json",
+		},
+		{
+			name:       "invalid budget",
+			body:       `{"user_id": "alice", "query": "q", "budget": "max"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_budget",
+		},
+		{
+			name:       "max_tokens out of range",
+			body:       `{"user_id": "alice", "query": "q", "max_tokens": -5}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "invalid reflect mode",
+			body:       `{"user_id": "alice", "query": "q", "reflect_mode": "both"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "backend error",
+			body:       `{"user_id": "alice", "query": "q"}`,
+			status:     http.StatusServiceUnavailable,
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "upstream_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{
+				status:  tt.status,
+				results: []hindsight.RecallResult{{Id: "m1", Text: "alice uses Go", Tags: []string{"project"}}},
+				answer:  "You use Go.",
+				basedOn: []hindsight.ReflectFact{{Id: *hindsight.NewNullableString(hindsight.PtrString("m1")), Text: "alice uses Go"}},
+			}
+			w := httptest.NewRecorder()
+			newService(f).handleAsk(w, httptest.NewRequest("POST", cmp.Or(tt.url, "/ask"), strings.NewReader(tt.body)))
+
+			checkResponse(t, w, tt.wantStatus, tt.wantCode)
+			if tt.check != nil {
+				var resp AskResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, f, resp)
+			}
+		})
+	}
+}
+
+func TestAskRequireFacts(t *testing.T) {
+	ask := func(f *fakeAPI, body string) AskResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		newService(f).handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusOK, "")
+		var resp AskResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	f := &fakeAPI{answer: "Made up."}
+	resp := ask(f, `{"user_id": "alice", "query": "q", "require_facts": true, "store_interaction": false, "reflect_mode": "independent"}`)
+	if resp.Answer != noFactsAnswer || resp.FactCount != 0 || len(f.reflects) != 0 {
+		t.Errorf("response = %+v after %d reflects, want the canned answer without reflecting", resp, len(f.reflects))
+	}
+
+	// Off by default, and facts found are counted
+	f = &fakeAPI{answer: "Made up."}
+	if resp := ask(f, `{"user_id": "alice", "query": "q", "store_interaction": false}`); resp.Answer != "Made up." {
+		t.Errorf("answer = %q, want reflect's", resp.Answer)
+	}
+	f = &fakeAPI{answer: "You use Go.", results: []hindsight.RecallResult{{Id: "m1", Text: "alice uses Go"}}}
+	resp = ask(f, `{"user_id": "alice", "query": "q", "require_facts": true, "store_interaction": false}`)
+	if resp.Answer != "You use Go." || resp.FactCount != 1 {
+		t.Errorf("response = %+v, want reflect's answer from one fact", resp)
+	}
+}
+
+func TestAskNormalizeQuery(t *testing.T) {
+	normalizeQueries = true
+	defer func() { normalizeQueries = false }()
+
+	f := &fakeAPI{answer: "Alice."}
+	svc := newService(f)
+	svc.answers.ttl = time.Minute
+	for _, query := range []string{"What's my  name?", "what's my name"} {
+		w := httptest.NewRecorder()
+		svc.handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(`{"user_id": "alice", "query": "`+query+`"}`)))
+		checkResponse(t, w, http.StatusOK, "")
+	}
+	background.wg.Wait()
+
+	if len(f.recalls) != 1 || f.recalls[0].Query != "what's my name" {
+		t.Fatalf("recalls = %+v, want one normalized recall with the second ask cached", f.recalls)
+	}
+	if got := f.reflects[0].Query; got != "What's my  name?" {
+		t.Errorf("reflect query = %q, want the original", got)
+	}
+	if got := f.retains[0].Items[0].Content; !strings.Contains(got, `"What's my  name?"`) {
+		t.Errorf("stored interaction = %q, want the original question", got)
+	}
+}
+
+func TestAskEnsuresMissingBank(t *testing.T) {
+	// Creation fails once, so the bank is still missing at recall
+	f := &fakeAPI{answer: "Alice.", bankMissing: true, createFails: 1}
+	w := httptest.NewRecorder()
+	newService(f).handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(`{"user_id": "alice", "query": "q"}`)))
+	background.wg.Wait()
+	checkResponse(t, w, http.StatusOK, "")
+	if len(f.banks) != 2 {
+		t.Errorf("%d bank creations, want 2", len(f.banks))
+	}
+
+	f = &fakeAPI{bankMissing: true, createFails: 2}
+	w = httptest.NewRecorder()
+	newService(f).handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(`{"user_id": "alice", "query": "q"}`)))
+	checkResponse(t, w, http.StatusBadGateway, "bank_unavailable")
+
+	// Without ensureBank, as for /query, a missing bank is left alone
+	f = &fakeAPI{bankMissing: true}
+	newService(f).askShared(context.Background(), "alice", AskRequest{UserID: "alice", Query: "q"}, hindsight.MID, askOptions{})
+	if len(f.banks) != 0 {
+		t.Errorf("%d bank creations without ensureBank, want 0", len(f.banks))
+	}
+}
+
+func TestHandleQuery(t *testing.T) {
+	f := &fakeAPI{
+		results: []hindsight.RecallResult{{Id: "m1", Text: "alice uses Go"}},
+		answer:  "You use Go.",
+	}
+	w := httptest.NewRecorder()
+	newService(f).handleQuery(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"user_id": "alice", "query": "What do I use?", "budget": "low"}`)))
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "You use Go." || !slices.Equal(resp.Facts, []string{"alice uses Go"}) {
+		t.Errorf("response = %+v", resp)
+	}
+	if *f.recalls[0].Budget != hindsight.LOW {
+		t.Errorf("recall budget = %v, want low", *f.recalls[0].Budget)
+	}
+	if c := f.reflects[0].Context.Get(); c == nil || !strings.Contains(*c, "alice uses Go") {
+		t.Errorf("reflect context = %v, want the recalled facts", c)
+	}
+	background.wg.Wait()
+	if len(f.retains) != 0 || len(f.banks) != 0 {
+		t.Errorf("retains = %d, bank updates = %d; want no side effects", len(f.retains), len(f.banks))
+	}
+
+	w = httptest.NewRecorder()
+	newService(&fakeAPI{bankMissing: true}).handleQuery(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"user_id": "bob", "query": "q"}`)))
+	checkResponse(t, w, http.StatusNotFound, "bank_not_found")
+}
+
+func TestHandlePreviewAsk(t *testing.T) {
+	f := &fakeAPI{answer: "Use vim."}
+	body := `{"mission": "Terse pair programmer.", "query": "Which editor?", "facts": ["alice uses Go"]}`
+	w := httptest.NewRecorder()
+	newService(f).handlePreviewAsk(w, httptest.NewRequest("POST", "/preview-ask", strings.NewReader(body)))
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp PreviewAskResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "Use vim." {
+		t.Errorf("answer = %q", resp.Answer)
+	}
+	if len(f.banks) != 1 || *f.banks[0].Mission.Get() != "Terse pair programmer." {
+		t.Fatalf("banks created = %+v, want one with the mission", f.banks)
+	}
+	if c := f.reflects[0].Context.Get(); c == nil || !strings.Contains(*c, "alice uses Go") {
+		t.Errorf("reflect context = %v, want the facts", c)
+	}
+	if len(f.retains) != 0 {
+		t.Errorf("retains = %d, want nothing stored", len(f.retains))
+	}
+	if len(f.deleted) != 1 || !strings.HasPrefix(f.deleted[0], "preview-") {
+		t.Errorf("deleted banks = %q, want the preview bank", f.deleted)
+	}
+
+	w = httptest.NewRecorder()
+	newService(f).handlePreviewAsk(w, httptest.NewRequest("POST", "/preview-ask", strings.NewReader(`{"query": "Which editor?"}`)))
+	checkResponse(t, w, http.StatusBadRequest, "invalid_request")
+}
+
+func TestHandleReplay(t *testing.T) {
+	// What hindsight lists for an interaction, with the text it extracted
+	interaction := func(query, answer, at string) map[string]any {
+		metadata := map[string]any{}
+		for k, v := range interactionMetadata(query, answer) {
+			metadata[k] = v
+		}
+		return map[string]any{"text": "The user asked about " + query, "context": "Q&A interaction", "mentioned_at": at, "metadata": metadata}
+	}
+	f := &fakeAPI{answer: "You use Go.", memories: []map[string]any{
+		interaction("Which editor?", "vim", "2026-01-01T10:00:00Z"),
+		{"text": formatInteraction("Stored without metadata", "x"), "context": "Q&A interaction"},
+		interaction("What language?", "You use Go.", "2026-01-03T10:00:00Z"),
+		{"text": "alice uses Go", "context": "notes", "metadata": map[string]any{"query": "Not an interaction"}},
+		interaction("Which editor?", "neovim", "2026-01-02T10:00:00Z"),
+		interaction("Which OS?", "Linux", ""),
+	}}
+	svc := newService(f)
+	if err := svc.bankSettings.set("user-alice", BankSettings{DefaultBudget: hindsight.LOW}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/replay/alice?n=3", nil)
+	r.SetPathValue("userID", "alice")
+	w := httptest.NewRecorder()
+	svc.handleReplay(w, r)
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp ReplayResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []ReplayResult{
+		{Query: "What language?", AskedAt: "2026-01-03T10:00:00Z", OldAnswer: "You use Go.", NewAnswer: "You use Go."},
+		{Query: "Which editor?", AskedAt: "2026-01-02T10:00:00Z", OldAnswer: "neovim", NewAnswer: "You use Go.", Changed: true},
+		{Query: "Which OS?", OldAnswer: "Linux", NewAnswer: "You use Go.", Changed: true},
+	}
+	if !reflect.DeepEqual(resp.Results, want) {
+		t.Errorf("results = %+v, want %+v", resp.Results, want)
+	}
+	background.wg.Wait()
+	if len(f.retains) != 0 {
+		t.Errorf("retains = %d, want replays not stored", len(f.retains))
+	}
+	// The user's default budget applies, as it would to /ask
+	if len(f.reflects) == 0 {
+		t.Error("nothing replayed")
+	}
+	for _, req := range f.reflects {
+		if req.Budget == nil || *req.Budget != hindsight.LOW {
+			t.Errorf("replay budget = %v, want the user's low", req.Budget)
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/replay/alice?budget=huge", nil)
+	r.SetPathValue("userID", "alice")
+	w = httptest.NewRecorder()
+	svc.handleReplay(w, r)
+	checkResponse(t, w, http.StatusBadRequest, "invalid_budget")
+}
+
+func TestFactsAsCSV(t *testing.T) {
+	f := &fakeAPI{
+		results: []hindsight.RecallResult{
+			{Id: "1", Text: `Alice said "hi, there"`, Type: *hindsight.NewNullableString(hindsight.PtrString("world")), Tags: []string{"a", "b"}},
+			{Id: "2", Text: "two\nlines"},
+		},
+		memories: []map[string]any{
+			{"text": "Uses Go, Rust", "fact_type": "world", "tags": []any{"work"}},
+			{"text": "untyped"},
+		},
+	}
+	svc := newService(f)
+	get := func(handler http.HandlerFunc, url string) [][]string {
+		t.Helper()
+		r := httptest.NewRequest("GET", url, nil)
+		r.SetPathValue("userID", "alice")
+		r.Header.Set("Accept", "text/csv")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		checkResponse(t, w, http.StatusOK, "")
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("Content-Type = %q, want text/csv", ct)
+		}
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+
+	rows := get(svc.handleRecall, "/recall/alice?q=hi")
+	want := [][]string{{"text", "type", "tags"}, {`Alice said "hi, there"`, "world", "a,b"}, {"two\nlines", "unknown", ""}}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("recall rows = %q, want %q", rows, want)
+	}
+
+	rows = get(svc.handleExport, "/export/alice")
+	want = [][]string{{"text", "type", "tags"}, {"Uses Go, Rust", "world", "work"}, {"untyped", "unknown", ""}}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("export rows = %q, want %q", rows, want)
+	}
+}
+
+func TestMergeBanks(t *testing.T) {
+	f := &fakeAPI{bankMemories: map[string][]map[string]any{
+		"user-alice": {
+			{"text": "Alice uses Go", "tags": []any{"work"}, "context": "chat"},
+			{"text": "Alice lives in Berlin"},
+		},
+		"user-alice2": {{"text": "Alice lives in Berlin"}},
+	}}
+	svc := newService(f)
+	svc.bankSettings.set("user-alice", BankSettings{DefaultBudget: hindsight.HIGH})
+	w := httptest.NewRecorder()
+	svc.handleMergeBanks(w, httptest.NewRequest("POST", "/bank/merge", strings.NewReader(`{"from_user": "alice", "to_user": "alice2", "delete_source": true}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["copied"] != 1.0 || resp["skipped_duplicates"] != 1.0 || resp["failed"] != 0.0 || resp["source_deleted"] != true {
+		t.Errorf("response = %v, want one copied, one duplicate and the source deleted", resp)
+	}
+	if len(f.retains) != 1 || len(f.retains[0].Items) != 1 {
+		t.Fatalf("retains = %+v, want only the new memory", f.retains)
+	}
+	if item := f.retains[0].Items[0]; item.Content != "Alice uses Go" || !slices.Equal(item.Tags, []string{"work"}) || item.GetContext() != "chat" {
+		t.Errorf("retained %+v, want the memory with its tags and context", item)
+	}
+	if !slices.Equal(f.deleted, []string{"user-alice"}) {
+		t.Errorf("deleted = %v, want the source bank", f.deleted)
+	}
+	if got := svc.bankSettings.get("user-alice2"); got.DefaultBudget != hindsight.HIGH {
+		t.Errorf("destination settings = %+v, want the source's", got)
+	}
+
+	// A failed copy keeps the source
+	f = &fakeAPI{memories: []map[string]any{{"text": "x"}}, bankMemories: map[string][]map[string]any{"user-bob2": nil}, dropItems: 1}
+	w = httptest.NewRecorder()
+	newService(f).handleMergeBanks(w, httptest.NewRequest("POST", "/bank/merge", strings.NewReader(`{"from_user": "bob", "to_user": "bob2", "delete_source": true}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	resp = nil
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["failed"] != 1.0 || resp["source_deleted"] != false || len(f.deleted) != 0 {
+		t.Errorf("response = %v, deleted = %v; want the source kept", resp, f.deleted)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code string
+	}{
+		{`{"from_user": "alice"}`, "invalid_request"},
+		{`{"from_user": "alice", "to_user": "Alice"}`, "invalid_request"},
+		{`{"from_user": "bad user", "to_user": "alice"}`, "invalid_user_id"},
+	} {
+		w := httptest.NewRecorder()
+		newService(&fakeAPI{}).handleMergeBanks(w, httptest.NewRequest("POST", "/bank/merge", strings.NewReader(tt.body)))
+		checkResponse(t, w, http.StatusBadRequest, tt.code)
+	}
+	w = httptest.NewRecorder()
+	newService(&fakeAPI{bankMissing: true}).handleMergeBanks(w, httptest.NewRequest("POST", "/bank/merge", strings.NewReader(`{"from_user": "carol", "to_user": "dave"}`)))
+	checkResponse(t, w, http.StatusNotFound, "bank_not_found")
+}
+
+func TestHandleRecall(t *testing.T) {
+	threeFacts := []hindsight.RecallResult{{Id: "1", Text: "a"}, {Id: "2", Text: "b"}, {Id: "3", Text: "c"}}
+
+	tests := []struct {
+		name        string
+		url         string
+		results     []hindsight.RecallResult
+		status      int
+		bankMissing bool
+		wantStatus  int
+		wantCode    string
+		check       func(t *testing.T, f *fakeAPI, resp RecallResponse)
+	}{
+		{
+			name:       "tags and budget",
+			url:        "/recall/alice?q=editor&tags=a,b&budget=low",
+			results:    threeFacts,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				recall := f.recalls[0]
+				if recall.Query != "editor" || *recall.Budget != hindsight.LOW {
+					t.Errorf("recall request = %+v, want query editor at low budget", recall)
+				}
+				if !slices.Equal(recall.Tags, []string{"a", "b"}) || recall.TagsMatch == nil || *recall.TagsMatch != "any_strict" {
+					t.Errorf("recall tags = %v %v, want [a b] any_strict", recall.Tags, recall.TagsMatch)
+				}
+				if resp.Total != 3 || len(resp.Results) != 3 || resp.Results[0].ID != "1" {
+					t.Errorf("response = %+v", resp)
+				}
+			},
+		},
+		{
+			name:       "mixed-case tags",
+			url:        "/recall/alice?tags=Preferences,%20Work%20",
+			results:    threeFacts,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				if tags := f.recalls[0].Tags; !slices.Equal(tags, []string{"preferences", "work"}) {
+					t.Errorf("recall tags = %v, want them normalized like stored tags", tags)
+				}
+			},
+		},
+		{
+			name:       "paged",
+			url:        "/recall/alice?limit=2&offset=1",
+			results:    threeFacts,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				if *f.recalls[0].Budget != hindsight.HIGH {
+					t.Errorf("budget = %v, want the high default", *f.recalls[0].Budget)
+				}
+				if len(resp.Results) != 2 || resp.Results[0].Text != "b" || resp.HasMore {
+					t.Errorf("response = %+v, want b and c with no more", resp)
+				}
+			},
+		},
+		{
+			name: "type filter",
+			url:  "/recall/alice?type=World",
+			results: []hindsight.RecallResult{
+				{Id: "1", Text: "a", Type: *hindsight.NewNullableString(hindsight.PtrString("world"))},
+				{Id: "2", Text: "b", Type: *hindsight.NewNullableString(hindsight.PtrString("experience"))},
+				{Id: "3", Text: "c"},
+			},
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				if resp.Total != 1 || resp.Results[0].ID != "1" {
+					t.Errorf("response = %+v, want only the world fact", resp)
+				}
+			},
+		},
+		{
+			name:       "untyped filter",
+			url:        "/recall/alice?type=unknown",
+			results:    []hindsight.RecallResult{{Id: "1", Text: "a", Type: *hindsight.NewNullableString(hindsight.PtrString("world"))}, {Id: "2", Text: "b"}},
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				if resp.Total != 1 || resp.Results[0].ID != "2" {
+					t.Errorf("response = %+v, want only the untyped fact", resp)
+				}
+			},
+		},
+		{
+			name: "ranked by importance",
+			url:  "/recall/alice",
+			results: []hindsight.RecallResult{
+				{Id: "1", Text: "a", Metadata: map[string]string{"importance": "2"}},
+				{Id: "2", Text: "b"},
+				{Id: "3", Text: "c", Metadata: map[string]string{"importance": "5"}},
+				{Id: "4", Text: "d"},
+			},
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				var ids []string
+				for _, fact := range resp.Results {
+					ids = append(ids, fact.ID)
+				}
+				if !slices.Equal(ids, []string{"3", "2", "4", "1"}) || resp.Results[0].Importance != 5 || resp.Results[1].Importance != defaultImportance {
+					t.Errorf("results = %+v, want 3, then 2 and 4 in recall order, then 1", resp.Results)
+				}
+			},
+		},
+		{
+			name: "time range",
+			url:  "/recall/alice?since=2024-05-01T00:00:00Z&until=2024-05-08T00:00:00Z",
+			results: []hindsight.RecallResult{
+				{Id: "1", Text: "a", MentionedAt: *hindsight.NewNullableString(hindsight.PtrString("2024-04-30T23:59:59Z"))},
+				{Id: "2", Text: "b", MentionedAt: *hindsight.NewNullableString(hindsight.PtrString("2024-05-03T10:00:00.123456+02:00"))},
+				{Id: "3", Text: "c"},
+				{Id: "4", Text: "d", MentionedAt: *hindsight.NewNullableString(hindsight.PtrString("2024-05-08T00:00:00Z"))},
+			},
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, f *fakeAPI, resp RecallResponse) {
+				if resp.Total != 2 || resp.Results[0].ID != "2" || resp.Results[1].ID != "4" {
+					t.Errorf("response = %+v, want the facts mentioned that week", resp)
+				}
+			},
+		},
+		{
+			name:       "invalid since",
+			url:        "/recall/alice?since=last-week",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "since after until",
+			url:        "/recall/alice?since=2024-05-08T00:00:00Z&until=2024-05-01T00:00:00Z",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+		{
+			name:       "existing bank with no matches",
+			url:        "/recall/alice?q=nothing",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "missing bank",
+			url:         "/recall/alice",
+			bankMissing: true,
+			wantStatus:  http.StatusNotFound,
+			wantCode:    "bank_not_found",
+		},
+		{
+			name:       "invalid user",
+			url:        "/recall/a%20b",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_user_id",
+		},
+		{
+			name:       "backend error",
+			url:        "/recall/alice",
+			status:     http.StatusUnauthorized,
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "upstream_unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{status: tt.status, results: tt.results, bankMissing: tt.bankMissing}
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /recall/{userID}", newService(f).handleRecall)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+
+			checkResponse(t, w, tt.wantStatus, tt.wantCode)
+			if tt.check != nil {
+				var resp RecallResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, f, resp)
+			}
+		})
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	var array, ndjson strings.Builder
+	array.WriteString("[")
+	for i := range importBatchSize + 1 {
+		line := fmt.Sprintf(`{"text": "fact %d", "tags": ["import"]}`, i)
+		if i > 0 {
+			array.WriteString(",")
+		}
+		array.WriteString(line)
+		ndjson.WriteString(line + "\n")
+	}
+	array.WriteString("]")
+	ndjson.WriteString("\n" + `{"text": ""}` + "\n")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+		want        map[string]any
+	}{
+		{name: "json array", body: array.String(), wantStatus: http.StatusOK,
+			want: map[string]any{"processed": 51.0, "imported": 51.0, "failed": 0.0, "batches": 2.0}},
+		{name: "ndjson", contentType: "application/x-ndjson", body: ndjson.String(), wantStatus: http.StatusOK,
+			want: map[string]any{"processed": 52.0, "imported": 51.0, "failed": 1.0, "batches": 2.0}},
+		{name: "ndjson bad line", contentType: "application/x-ndjson", body: `{"text": "ok"}` + "\n{nope\n", wantStatus: http.StatusBadRequest, wantCode: "invalid_json"},
+		{name: "not an array", body: `{"text": "fact"}`, wantStatus: http.StatusBadRequest, wantCode: "invalid_json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{}
+			r := httptest.NewRequest("POST", "/import/alice", strings.NewReader(tt.body))
+			r.SetPathValue("userID", "alice")
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			newService(f).handleImport(w, r)
+
+			checkResponse(t, w, tt.wantStatus, tt.wantCode)
+			if tt.want == nil {
+				return
+			}
+			var resp map[string]any
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if resp[k] != v {
+					t.Errorf("%s = %v, want %v", k, resp[k], v)
+				}
+			}
+			if len(f.retains) != 2 || len(f.retains[0].Items) != importBatchSize {
+				t.Errorf("retains = %d, want batches of %d", len(f.retains), importBatchSize)
+			}
+		})
+	}
+}
+
+func TestHandleRecallBatch(t *testing.T) {
+	f := &fakeAPI{results: []hindsight.RecallResult{{Id: "1", Text: "a"}, {Id: "2", Text: "b"}}}
+	body := `{"user_ids": ["alice", "bob", "../admin"], "query": "editor", "limit": 1}`
+	w := httptest.NewRecorder()
+	newService(f).handleRecallBatch(w, httptest.NewRequest("POST", "/recall/batch", strings.NewReader(body)))
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp struct {
+		Results map[string]RecallBatchResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		got := resp.Results[user]
+		if got.BankID != "user-"+user || got.Total != 2 || len(got.Results) != 1 || got.Error != nil {
+			t.Errorf("%s: %+v, want 1 of 2 facts from its bank", user, got)
+		}
+	}
+	if got := resp.Results["../admin"]; got.Error == nil || got.Error.Code != "invalid_user_id" {
+		t.Errorf("invalid user: %+v, want an inline invalid_user_id error", got)
+	}
+	if len(f.recalls) != 2 || *f.recalls[0].Budget != hindsight.HIGH {
+		t.Errorf("recalls = %+v, want one per valid user at high budget", f.recalls)
+	}
+
+	w = httptest.NewRecorder()
+	newService(f).handleRecallBatch(w, httptest.NewRequest("POST", "/recall/batch", strings.NewReader(`{"user_ids": [], "query": "editor"}`)))
+	checkResponse(t, w, http.StatusBadRequest, "invalid_request")
+}
+
+func TestHandleUpdateMission(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		want       BankInfo
+	}{
+		{
+			name:       "mission only",
+			body:       `{"mission": " Terse pair programmer. "}`,
+			wantStatus: http.StatusOK,
+			want:       BankInfo{BankID: "user-alice", Mission: "Terse pair programmer."},
+		},
+		{
+			name:       "mission and name",
+			body:       `{"mission": "Reviewer", "name": "Alice's reviewer"}`,
+			wantStatus: http.StatusOK,
+			want:       BankInfo{BankID: "user-alice", Name: "Alice's reviewer", Mission: "Reviewer"},
+		},
+		{
+			name:       "empty mission",
+			body:       `{"mission": "  "}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAPI{}
+			mux := http.NewServeMux()
+			mux.HandleFunc("PUT /bank/{userID}/mission", newService(f).handleUpdateMission)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("PUT", "/bank/alice/mission", strings.NewReader(tt.body)))
+
+			checkResponse(t, w, tt.wantStatus, tt.wantCode)
+			if tt.wantCode != "" {
+				if len(f.banks) != 0 {
+					t.Errorf("bank updated on invalid request: %+v", f.banks)
+				}
+				return
+			}
+			var got BankInfo
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats/{userID}", svc.handleStats)
+	mux.HandleFunc("DELETE /forget/{userID}", svc.handleForget)
+	stats := func(userID string, wantStatus int, wantCode string) MemoryStats {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/stats/"+userID, nil))
+		checkResponse(t, w, wantStatus, wantCode)
+		var resp MemoryStats
+		if wantCode == "" {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	// A bank that exists but is empty has zero counts
+	if got := stats("bob", http.StatusOK, ""); got.Total != 0 || got.ByType == nil || len(got.ByTag) != 0 {
+		t.Errorf("empty bank stats = %+v, want zero counts", got)
+	}
+
+	f.bankMemories = map[string][]map[string]any{"user-alice": {
+		{"id": "m1", "text": "a", "fact_type": "world", "tags": []any{"work"}},
+		{"id": "m2", "text": "b", "fact_type": "world"},
+	}}
+	if got := stats("alice", http.StatusOK, ""); got.Total != 2 || got.ByType["world"] != 2 || got.ByTag["work"] != 1 {
+		t.Errorf("stats = %+v, want 2 world facts, 1 tagged work", got)
+	}
+
+	// Forgetting drops the cached stats, so the deleted bank is reported
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/forget/alice", nil))
+	checkResponse(t, w, http.StatusOK, "")
+	f.bankMemories, f.bankMissing = nil, true
+	stats("alice", http.StatusNotFound, "bank_not_found")
+	stats("carol", http.StatusNotFound, "bank_not_found")
+}
+
+func TestCmdLearnTags(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	if err := svc.cmdLearn([]string{"--user", "alice", "--content", "x", "--tags", "expires:0"}); err == nil || len(f.retains) != 0 {
+		t.Errorf("learn --tags expires:0 = %v, retains %d; want it refused", err, len(f.retains))
+	}
+	if err := svc.cmdLearn([]string{"--user", "alice", "--content", "x", "--tags", "Work, work"}); err != nil {
+		t.Fatal(err)
+	}
+	if tags := f.retains[0].Items[0].Tags; !slices.Equal(tags, []string{"work"}) {
+		t.Errorf("learned tags = %v, want them normalized", tags)
+	}
+}
+
+func TestHandleForgetTag(t *testing.T) {
+	f := &fakeAPI{memories: []map[string]any{
+		{"id": "m1", "tags": []any{"work"}},
+		{"id": "m2", "tags": []any{"home"}},
+	}}
+	r := httptest.NewRequest("DELETE", "/forget/alice?tag=%20Work", nil)
+	r.SetPathValue("userID", "alice")
+	w := httptest.NewRecorder()
+	newService(f).handleForget(w, r)
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["tag"] != "work" || resp["deleted_count"] != 1.0 || !slices.Equal(f.forgot, []string{"m1"}) {
+		t.Errorf("forget ?tag=Work = %v, deleted %v; want m1, tagged work", resp, f.forgot)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("banks deleted = %v, want only the tagged memory", f.deleted)
+	}
+}
+
+func TestHandleBanks(t *testing.T) {
+	f := &fakeAPI{bankList: []hindsight.BankListItem{
+		{BankId: "user-bob"},
+		{BankId: "other-carol"},
+		{BankId: "preview-1234"},
+		{BankId: "user-acme-dave"},
+		{BankId: "user-alice"},
+		{BankId: "user-globex-erin"},
+	}}
+	svc := newService(f)
+	list := func(tenant, query string) BanksResponse {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/banks"+query, nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		svc.handleBanks(w, r)
+		checkResponse(t, w, http.StatusOK, "")
+		var resp BanksResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	ids := func(resp BanksResponse) []string {
+		var out []string
+		for _, b := range resp.Banks {
+			out = append(out, b.BankID)
+		}
+		return out
+	}
+
+	// Other deployments' banks, and preview banks, are never listed
+	resp := list("", "?limit=2")
+	if got := ids(resp); !slices.Equal(got, []string{"user-acme-dave", "user-alice"}) || resp.NextCursor != "user-alice" {
+		t.Errorf("first page = %v, next %q", got, resp.NextCursor)
+	}
+	if got := ids(list("", "?cursor=user-alice")); !slices.Equal(got, []string{"user-bob", "user-globex-erin"}) {
+		t.Errorf("second page = %v", got)
+	}
+	// A tenant only sees its own banks
+	if got := ids(list("ACME", "")); !slices.Equal(got, []string{"user-acme-dave"}) {
+		t.Errorf("acme's banks = %v", got)
+	}
+
+	r := httptest.NewRequest("GET", "/banks", nil)
+	r.Header.Set("X-Tenant-ID", "a-b")
+	w := httptest.NewRecorder()
+	svc.handleBanks(w, r)
+	checkResponse(t, w, http.StatusBadRequest, "invalid_user_id")
+}
+
+func TestBackendOverrideSharesBankSettings(t *testing.T) {
+	svc := newService(&fakeAPI{})
+	o := svc.forBackend("http://other:8888", &fakeAPI{})
+	if err := o.bankSettings.set("user-alice", BankSettings{DefaultBudget: hindsight.LOW}); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.bankSettings.get("user-alice"); got.DefaultBudget != hindsight.LOW {
+		t.Errorf("settings set through an override = %+v, want them shared", got)
+	}
+}
+
+func TestReensureKeepsMission(t *testing.T) {
+	f := &fakeAPI{}
+	svc := newService(f)
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /bank/{userID}/mission", svc.handleUpdateMission)
+	mux.HandleFunc("PUT /bank/{userID}/settings", svc.handleUpdateBankSettings)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/bank/alice/mission", strings.NewReader(`{"mission": "Reviewer", "name": "Alice's reviewer"}`)))
+	checkResponse(t, w, http.StatusOK, "")
+	// Replacing the settings leaves the mission alone
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/bank/alice/settings", strings.NewReader(`{"default_budget": "low"}`)))
+	checkResponse(t, w, http.StatusOK, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.reensureBanks(ctx, 50*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		// A pass only re-ensures banks used since the previous one
+		svc.banks.touch("user-alice", "alice")
+		f.mu.Lock()
+		n := len(f.banks)
+		f.mu.Unlock()
+		if n > 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bank not re-ensured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req := f.banks[1]
+	if got := req.Mission.Get(); got == nil || *got != "Reviewer" {
+		t.Errorf("re-ensured mission = %v, want Reviewer", got)
+	}
+	if got := req.Name.Get(); got == nil || *got != "Alice's reviewer" {
+		t.Errorf("re-ensured name = %v, want Alice's reviewer", got)
+	}
+}
+
+func TestHandleBankSettings(t *testing.T) {
+	f := &fakeAPI{answer: "A."}
+	svc := newService(f)
+	svc.bankSettings.path = filepath.Join(t.TempDir(), "settings.json")
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/bank/alice/settings", strings.NewReader(body))
+		req.SetPathValue("userID", "alice")
+		svc.handleUpdateBankSettings(w, req)
+		return w
+	}
+
+	checkResponse(t, put(`{"default_budget": "huge"}`), http.StatusBadRequest, "invalid_budget")
+	checkResponse(t, put(`{"default_max_tokens": 100000}`), http.StatusBadRequest, "invalid_request")
+	checkResponse(t, put(`{"default_budget": "low", "default_max_tokens": 512}`), http.StatusOK, "")
+
+	// Asks and recalls without their own budget use the user's
+	ask := func(body string) {
+		w := httptest.NewRecorder()
+		svc.handleAsk(w, httptest.NewRequest("POST", "/ask", strings.NewReader(body)))
+		checkResponse(t, w, http.StatusOK, "")
+	}
+	ask(`{"user_id": "alice", "query": "q", "store_interaction": false}`)
+	ask(`{"user_id": "alice", "query": "q", "budget": "high", "max_tokens": 1024, "store_interaction": false}`)
+	if got := f.recalls[0]; *got.Budget != hindsight.LOW || *got.MaxTokens != 512 {
+		t.Errorf("ask recall = %v/%d, want the user's low/512", *got.Budget, *got.MaxTokens)
+	}
+	if got := f.recalls[1]; *got.Budget != hindsight.HIGH || *got.MaxTokens != 1024 {
+		t.Errorf("ask recall = %v/%d, want the request's high/1024", *got.Budget, *got.MaxTokens)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/recall/alice", nil)
+	req.SetPathValue("userID", "alice")
+	svc.handleRecall(w, req)
+	if got := *f.recalls[2].Budget; got != hindsight.LOW {
+		t.Errorf("recall budget = %v, want the user's low", got)
+	}
+
+	// Settings are saved, and {} clears them
+	loaded := newBankSettingsStore()
+	loaded.path = svc.bankSettings.path
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.get("user-alice"); got != (BankSettings{DefaultBudget: hindsight.LOW, DefaultMaxTokens: 512}) {
+		t.Errorf("saved settings = %+v", got)
+	}
+	checkResponse(t, put(`{}`), http.StatusOK, "")
+	if got := svc.bankSettings.get("user-alice"); got != (BankSettings{}) {
+		t.Errorf("settings after {} = %+v, want none", got)
+	}
+}
+
+func TestHandleDebugHindsight(t *testing.T) {
+	svc := newService(&fakeAPI{})
+	svc.backends = []backend{{url: "http://a:8888", api: &fakeAPI{}}, {url: "http://b:8888", api: &fakeAPI{status: http.StatusBadGateway}}}
+	w := httptest.NewRecorder()
+	svc.handleDebugHindsight(w, httptest.NewRequest("GET", "/debug/hindsight", nil))
+
+	checkResponse(t, w, http.StatusOK, "")
+	var resp struct{ Servers []BackendStatus }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Servers) != 2 || resp.Servers[0].ServerURL != "http://a:8888" || !resp.Servers[0].Reachable || resp.Servers[0].Error != "" {
+		t.Fatalf("servers = %+v, want a healthy first server", resp.Servers)
+	}
+	if got := resp.Servers[1]; got.StatusCode != http.StatusBadGateway || got.Error == "" {
+		t.Errorf("second server = %+v, want its 502 reported", got)
+	}
+}
+
+func TestHandleDebugConfig(t *testing.T) {
+	t.Setenv("ASK_TIMEOUT", "5s")
+	envDuration("ASK_TIMEOUT", time.Minute)
+	envDuration("RECALL_TIMEOUT", 10*time.Second)
+	noteSetting("SERVICE_AUTH_TOKEN", "s3cret")
+
+	svc := newService(&fakeAPI{})
+	svc.backends = []backend{{url: "http://a:8888", api: &fakeAPI{}}}
+	w := httptest.NewRecorder()
+	svc.handleDebugConfig(w, httptest.NewRequest("GET", "/debug/config", nil))
+	checkResponse(t, w, http.StatusOK, "")
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Fatalf("body = %s, leaks SERVICE_AUTH_TOKEN", w.Body)
+	}
+
+	var resp ConfigResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Settings["ASK_TIMEOUT"]; got != (SettingValue{"5s", "env"}) {
+		t.Errorf("ASK_TIMEOUT = %+v, want 5s from env", got)
+	}
+	if got := resp.Settings["RECALL_TIMEOUT"]; got != (SettingValue{"10s", "default"}) {
+		t.Errorf("RECALL_TIMEOUT = %+v, want the 10s default", got)
+	}
+	if !slices.Equal(resp.HindsightURLs, []string{"http://a:8888"}) || resp.Budgets["recall"] != hindsight.HIGH {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestHandleDebugRecall(t *testing.T) {
+	f := &fakeAPI{results: []hindsight.RecallResult{{Id: "1", Text: "alice uses Go", DocumentId: *hindsight.NewNullableString(hindsight.PtrString("doc-1"))}}}
+	body := `{"user_id": "alice", "request": {"query": "language", "budget": "low", "max_tokens": 500}}`
+	w := httptest.NewRecorder()
+	newService(f).handleDebugRecall(w, httptest.NewRequest("POST", "/debug/recall", strings.NewReader(body)))
+
+	checkResponse(t, w, http.StatusOK, "")
+	if got := f.recalls[0]; got.Query != "language" || *got.Budget != hindsight.LOW || *got.MaxTokens != 500 {
+		t.Errorf("recall request = %+v, want it passed through", got)
+	}
+	if !strings.Contains(w.Body.String(), `"document_id":"doc-1"`) {
+		t.Errorf("body = %s, want the fields /recall drops", w.Body)
+	}
+}
+
+func TestHandleClearCache(t *testing.T) {
+	svc := newService(&fakeAPI{})
+	svc.answers.ttl = time.Minute
+	svc.banks.do(context.Background(), "user-alice", func() bool { return true })
+	_, gen, _ := svc.answers.get("user-alice", "q")
+	svc.answers.put("user-alice", "q", gen, AskResponse{Answer: "A"})
+
+	clearCache := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		svc.handleClearCache(w, httptest.NewRequest("POST", "/admin/cache/clear", strings.NewReader(body)))
+		return w
+	}
+
+	w := clearCache(`{"which": "banks"}`)
+	checkResponse(t, w, http.StatusOK, "")
+	var resp struct{ Cleared map[string]int }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Cleared) != 1 || resp.Cleared["banks"] != 1 {
+		t.Errorf("cleared = %v, want just the one bank", resp.Cleared)
+	}
+	if _, _, ok := svc.answers.get("user-alice", "q"); !ok {
+		t.Error("clearing banks dropped a cached answer")
+	}
+
+	w = clearCache(`{}`)
+	checkResponse(t, w, http.StatusOK, "")
+	resp.Cleared = nil
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Cleared) != 5 || resp.Cleared["answers"] != 1 || resp.Cleared["banks"] != 0 {
+		t.Errorf("cleared = %v, want every cache, with the answer", resp.Cleared)
+	}
+
+	checkResponse(t, clearCache(`{"which": "everything"}`), http.StatusBadRequest, "invalid_request")
+}
+
+func TestWaitForBackend(t *testing.T) {
+	if !newService(&fakeAPI{}).waitForBackend(context.Background(), time.Second) {
+		t.Error("waitForBackend = false for a reachable backend")
+	}
+	if newService(&fakeAPI{status: http.StatusServiceUnavailable}).waitForBackend(context.Background(), 50*time.Millisecond) {
+		t.Error("waitForBackend = true for an unreachable backend")
+	}
+}
+
+func TestExpandQuery(t *testing.T) {
+	expandQueries = true
+	defer func() { expandQueries = false }()
+
+	f := &fakeAPI{answer: "\"editor IDE vim neovim\"\nignored"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /recall/{userID}", newService(f).handleRecall)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/recall/alice?q=editor&verbose=true", nil))
+
+	checkResponse(t, w, http.StatusOK, "")
+	const want = "editor editor IDE vim neovim"
+	if got := f.recalls[0].Query; got != want {
+		t.Errorf("recall query = %q, want %q", got, want)
+	}
+	var resp RecallResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExpandedQuery != want {
+		t.Errorf("expanded_query = %q, want %q", resp.ExpandedQuery, want)
+	}
+
+	// Long queries are left alone
+	long := "what editor do I use for writing Go code"
+	if got := newService(f).expandQuery(context.Background(), "user-alice", long); got != long {
+		t.Errorf("expandQuery(%q) = %q, want it unchanged", long, got)
+	}
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	f := &fakeAPI{status: http.StatusTooManyRequests}
+	w := httptest.NewRecorder()
+	newService(f).handleLearn(w, httptest.NewRequest("POST", "/learn", strings.NewReader(`{"user_id": "alice", "content": "x"}`)))
+
+	checkResponse(t, w, http.StatusTooManyRequests, "upstream_rate_limited")
+	if got := w.Header().Get("Retry-After"); got != "7" {
+		t.Errorf("Retry-After = %q, want hindsight's 7", got)
+	}
+}
+
+// checkResponse fails the test unless w has the wanted status and, for
+// errors, the wanted error code.
+func checkResponse(t *testing.T, w *httptest.ResponseRecorder, wantStatus int, wantCode string) {
+	t.Helper()
+	if w.Code != wantStatus {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, wantStatus, w.Body)
+	}
+	if wantCode == "" {
+		return
+	}
+	var errResp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Error.Code != wantCode {
+		t.Errorf("error code = %q, want %q", errResp.Error.Code, wantCode)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// highlightContext is how many characters of a fact are kept on each side
+// of the first match in a highlight.
+const highlightContext = 40
+
+// queryTerms returns the distinct lower-cased words of query that are worth
+// highlighting: runs of letters and digits at least three long.
+func queryTerms(query string) [][]rune {
+	var terms [][]rune
+	for _, word := range strings.FieldsFunc(query, func(r rune) bool { return !isWordRune(r) }) {
+		term := []rune(strings.Map(unicode.ToLower, word))
+		if len(term) >= 3 && !slices.ContainsFunc(terms, func(t []rune) bool { return slices.Equal(t, term) }) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// highlight returns an excerpt of text around the first word starting with
+// one of terms, with every such word in the excerpt wrapped in ** (as in
+// Markdown bold). Cut ends are marked with "…". It returns "" if no term
+// matches. Matching is by word prefix, case-insensitive, so it only
+// approximates what recall found relevant.
+func highlight(text string, terms [][]rune) string {
+	src := []rune(text)
+	lower := make([]rune, len(src))
+	for i, r := range src {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	type span struct{ start, end int }
+	var matches []span
+	for i := 0; i < len(lower); i++ {
+		if i > 0 && isWordRune(lower[i-1]) {
+			continue
+		}
+		for _, term := range terms {
+			if len(lower)-i >= len(term) && slices.Equal(lower[i:i+len(term)], term) {
+				// Mark the whole word the term starts
+				end := i + len(term)
+				for end < len(lower) && isWordRune(lower[end]) {
+					end++
+				}
+				matches = append(matches, span{i, end})
+				i = end - 1
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+
+	// Widen the window around the first match out to word boundaries, up to
+	// twice the context
+	first := matches[0]
+	start := max(first.start-highlightContext, 0)
+	for start > 0 && !unicode.IsSpace(src[start-1]) && first.start-start < 2*highlightContext {
+		start--
+	}
+	end := min(first.end+highlightContext, len(src))
+	for end < len(src) && !unicode.IsSpace(src[end]) && end-first.end < 2*highlightContext {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.end > end {
+			break
+		}
+		b.WriteString(string(src[pos:m.start]))
+		b.WriteString("**" + string(src[m.start:m.end]) + "**")
+		pos = m.end
+	}
+	b.WriteString(string(src[pos:end]))
+	if end < len(src) {
+		b.WriteString("…")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("filler words here ", 10)
+
+	tests := []struct {
+		name  string
+		query string
+		text  string
+		want  string
+	}{
+		{
+			name:  "every match in the excerpt",
+			query: "Which editor do I use?",
+			text:  "Alice uses Neovim as her editor and uses tmux",
+			want:  "Alice **uses** Neovim as her **editor** and **uses** tmux",
+		},
+		{
+			name:  "case-insensitive word prefix",
+			query: "postgres",
+			text:  "Runs PostgreSQL 16 in production",
+			want:  "Runs **PostgreSQL** 16 in production",
+		},
+		{
+			name:  "not inside a word",
+			query: "log",
+			text:  "Keeps a changelog",
+		},
+		{
+			name:  "short words ignored",
+			query: "go to",
+			text:  "go to work",
+		},
+		{
+			name:  "cut ends",
+			query: "deadlock",
+			text:  long + "debugged a deadlock in the pool " + long,
+			want:  "…words here filler words here debugged a **deadlock** in the pool filler words here filler words…",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlight(tt.text, queryTerms(tt.query)); got != tt.want {
+				t.Errorf("highlight = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
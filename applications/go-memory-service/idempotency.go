@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers /learn responses by Idempotency-Key for ttl,
+// so a retried request gets the original response instead of storing its
+// content again. It holds at most size keys, evicting the oldest when full.
+// A zero ttl disables it.
+type idempotencyCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	resp    any // nil while the original request is still running
+	expires time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, size int) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, size: size, entries: make(map[string]*idempotencyEntry)}
+}
+
+func (c *idempotencyCache) enabled() bool {
+	return c.ttl > 0 && c.size > 0
+}
+
+// claim reserves key for a new request. If a request with key already
+// completed, its response is returned instead; busy reports that one is
+// still running. The caller must follow a successful claim with complete
+// or release.
+func (c *idempotencyCache) claim(key string) (resp any, busy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		return entry.resp, entry.resp == nil
+	}
+
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for len(c.entries) >= c.size {
+		c.evictOldest()
+	}
+	c.entries[key] = &idempotencyEntry{expires: now.Add(c.ttl)}
+	return nil, false
+}
+
+// complete stores the response of the request that claimed key.
+func (c *idempotencyCache) complete(key string, resp any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &idempotencyEntry{resp: resp, expires: time.Now().Add(c.ttl)}
+}
+
+// release gives up a claim after a failed request, so a retry runs again.
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.resp == nil {
+		delete(c.entries, key)
+	}
+}
+
+// clear drops every completed response and returns how many there were.
+// Keys of requests still running stay claimed.
+func (c *idempotencyCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for k, entry := range c.entries {
+		if entry.resp != nil {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *idempotencyCache) evictOldest() {
+	var oldest string
+	var oldestExpires time.Time
+	for k, entry := range c.entries {
+		if oldest == "" || entry.expires.Before(oldestExpires) {
+			oldest, oldestExpires = k, entry.expires
+		}
+	}
+	delete(c.entries, oldest)
+}
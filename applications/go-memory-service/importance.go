@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// Importance ranks learned facts from 1 (least) to 5 (most). hindsight's
+// memory items have no importance or priority field, so it is stored in
+// the item's metadata under importanceKey, which recall returns with each
+// result, and applied here by rankByImportance. Facts learned without one
+// rank as defaultImportance.
+const (
+	minImportance     = 1
+	maxImportance     = 5
+	defaultImportance = 3
+
+	importanceKey = "importance"
+)
+
+// validImportance checks a /learn importance; 0 means unset.
+func validImportance(n int) error {
+	if n != 0 && (n < minImportance || n > maxImportance) {
+		return fmt.Errorf("importance must be between %d and %d", minImportance, maxImportance)
+	}
+	return nil
+}
+
+// importanceMetadata returns the memory item metadata recording n, or nil
+// if n is unset.
+func importanceMetadata(n int) map[string]string {
+	if n == 0 {
+		return nil
+	}
+	return map[string]string{importanceKey: strconv.Itoa(n)}
+}
+
+// resultImportance returns the importance a recalled fact was learned with.
+func resultImportance(result hindsight.RecallResult) int {
+	n, err := strconv.Atoi(result.GetMetadata()[importanceKey])
+	if err != nil || n < minImportance || n > maxImportance {
+		return defaultImportance
+	}
+	return n
+}
+
+// rankByImportance reorders recall results by descending importance.
+// Recall returns them by relevance and that order is kept among facts of
+// equal importance. Importance doesn't change which facts are recalled:
+// budget and max_tokens decide that.
+func rankByImportance(results []hindsight.RecallResult) {
+	slices.SortStableFunc(results, func(a, b hindsight.RecallResult) int {
+		return resultImportance(b) - resultImportance(a)
+	})
+}
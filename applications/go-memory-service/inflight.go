@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// inflight is a semaphore bounding concurrent hindsight calls
+	// (MAX_INFLIGHT). Calls wait at most inflightWait (INFLIGHT_WAIT) for a
+	// slot before failing with errOverloaded.
+	inflight     = make(chan struct{}, 32)
+	inflightWait = 500 * time.Millisecond
+)
+
+var errOverloaded = errors.New("too many in-flight hindsight calls")
+
+// acquireInflight takes a slot on the inflight semaphore, giving up when ctx
+// ends or inflightWait passes. The returned func releases the slot.
+func acquireInflight(ctx context.Context) (release func(), err error) {
+	timer := time.NewTimer(inflightWait)
+	defer timer.Stop()
+
+	select {
+	case inflight <- struct{}{}:
+		return func() { <-inflight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errOverloaded
+	}
+}
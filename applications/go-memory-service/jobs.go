@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job statuses reported by GET /jobs/{jobID}.
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job is one queued asynchronous learn. run performs it, writing the
+// response a synchronous /learn would have given.
+type job struct {
+	id      string
+	ctx     context.Context
+	run     func(ctx context.Context, w http.ResponseWriter)
+	created time.Time
+
+	// Guarded by jobQueue.mu
+	status   string
+	finished time.Time
+	code     int
+	body     json.RawMessage
+}
+
+// jobQueue runs asynchronous learns on workers goroutines, with up to size
+// jobs waiting for one. Finished jobs are kept for ttl so they can be
+// polled, and pruned as new jobs come in. Queued and running jobs are
+// tracked by background, so shutdown drains them.
+type jobQueue struct {
+	workers int
+	size    int
+	ttl     time.Duration
+
+	start sync.Once
+	queue chan *job
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// learnJobs queues POST /learn/async (LEARN_ASYNC_WORKERS,
+// LEARN_ASYNC_QUEUE, JOB_TTL). It is shared by every backend, so a job can
+// be polled without the X-Hindsight-URL it was submitted with.
+var learnJobs = &jobQueue{workers: 4, size: 100, ttl: time.Hour, jobs: make(map[string]*job)}
+
+// submit queues run and returns the new job's ID, or false if the queue is
+// full. run gets a context derived from ctx, which must outlive the request.
+func (q *jobQueue) submit(ctx context.Context, run func(ctx context.Context, w http.ResponseWriter)) (string, bool) {
+	q.start.Do(func() {
+		q.queue = make(chan *job, q.size)
+		for range q.workers {
+			go q.work()
+		}
+	})
+
+	j := &job{id: newRequestID(), ctx: ctx, run: run, created: time.Now(), status: jobPending}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	background.wg.Add(1)
+	select {
+	case q.queue <- j:
+	default:
+		background.wg.Done()
+		return "", false
+	}
+	q.jobs[j.id] = j
+	return j.id, true
+}
+
+func (q *jobQueue) work() {
+	for j := range q.queue {
+		q.runJob(j)
+	}
+}
+
+func (q *jobQueue) runJob(j *job) {
+	defer background.wg.Done()
+	ctx, cancel := context.WithTimeout(j.ctx, learnTimeout)
+	defer cancel()
+
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	j.run(ctx, rec)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.status = jobDone
+	if rec.status >= http.StatusBadRequest {
+		j.status = jobFailed
+	}
+	j.finished = time.Now()
+	j.code = rec.status
+	j.body = bytes.TrimSpace(rec.body.Bytes())
+}
+
+// get returns a snapshot of the job with the given ID.
+func (q *jobQueue) get(id string) (JobResponse, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok || q.expired(j) {
+		return JobResponse{}, false
+	}
+	resp := JobResponse{JobID: j.id, Status: j.status, CreatedAt: j.created}
+	if j.status == jobPending {
+		return resp, true
+	}
+	resp.FinishedAt = &j.finished
+	resp.StatusCode = j.code
+	if j.status == jobDone {
+		resp.Result = j.body
+		return resp, true
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal(j.body, &errResp); err != nil || errResp.Error.Code == "" {
+		errResp.Error = ErrorDetail{Code: "internal_error", Message: "the learn failed"}
+	}
+	resp.Error = &errResp.Error
+	return resp, true
+}
+
+// expired reports whether j finished more than ttl ago. It needs q.mu.
+func (q *jobQueue) expired(j *job) bool {
+	return j.status != jobPending && time.Since(j.finished) > q.ttl
+}
+
+// prune drops the expired jobs. It needs q.mu.
+func (q *jobQueue) prune() {
+	for id, j := range q.jobs {
+		if q.expired(j) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// jobRecorder is the http.ResponseWriter a job's response is written to.
+type jobRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *jobRecorder) Header() http.Header { return r.header }
+
+func (r *jobRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *jobRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(p)
+}
+
+// JobResponse is the state of an asynchronous learn, as returned by
+// GET /jobs/{jobID}. A finished job has the status code /learn would have
+// answered with, and either its result or its error.
+type JobResponse struct {
+	JobID      string          `json:"job_id"`
+	Status     string          `json:"status"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      *ErrorDetail    `json:"error,omitempty"`
+}
+
+// handleLearnAsync queues a /learn and answers at once with a job ID to
+// poll. The body, query and headers are those of /learn, and are only
+// validated when the job runs.
+func (s *Service) handleLearnAsync(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+		return
+	}
+
+	// Detached from the request's cancellation but keeps its request ID.
+	// The job gets its own requestInfo, as the access log reads this one.
+	ctx := context.WithValue(context.WithoutCancel(r.Context()), requestInfoKey, &requestInfo{id: requestID(r.Context())})
+	req := r.Clone(ctx)
+	id, ok := learnJobs.submit(ctx, func(ctx context.Context, w http.ResponseWriter) {
+		req := req.WithContext(ctx)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		s.handleLearn(w, req)
+	})
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "overloaded", "too many asynchronous learns queued, retry later")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSONBody(w, map[string]any{"job_id": id, "status": jobPending})
+}
+
+// handleJob returns the state of an asynchronous learn.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	resp, ok := learnJobs.get(r.PathValue("jobID"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "job_not_found", "no such job, or it finished too long ago")
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// answerLanguage resolves the language an answer should be written in: the
+// request's lang, a BCP 47 tag such as "fr" or "pt-BR", or else the first
+// language of the Accept-Language header. It returns the canonical tag, or
+// "" for "auto" and when neither names a language, leaving the choice to
+// reflect. A malformed lang is an error; a malformed header is ignored.
+func answerLanguage(lang, acceptLanguage string) (string, error) {
+	if lang = strings.TrimSpace(lang); lang != "" {
+		if strings.EqualFold(lang, "auto") {
+			return "", nil
+		}
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return "", fmt.Errorf("invalid lang %q: must be a language tag such as \"fr\" or \"pt-BR\", or \"auto\"", lang)
+		}
+		return tag.String(), nil
+	}
+
+	// Tags come back by descending preference, without q=0 entries. A "*"
+	// parses as "mul", and admits any language.
+	tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	for _, tag := range tags {
+		if tag != language.Und && tag.String() != "mul" {
+			return tag.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// languageInstruction returns the instruction prepended to a reflect query
+// to get an answer in lang, a tag from answerLanguage. hindsight's reflect
+// takes no language hint, so this is the only way to ask for one.
+func languageInstruction(lang string) string {
+	name := display.English.Tags().Name(language.Make(lang))
+	return fmt.Sprintf("Answer in %s.", cmp.Or(name, lang))
+}
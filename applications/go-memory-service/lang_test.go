@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestAnswerLanguage(t *testing.T) {
+	tests := []struct {
+		lang, acceptLanguage string
+		want                 string
+		wantErr              bool
+	}{
+		{},
+		{lang: "fr", want: "fr"},
+		{lang: " pt-br ", want: "pt-BR"},
+		{lang: "auto", acceptLanguage: "de", want: ""},
+		{lang: "fr", acceptLanguage: "de", want: "fr"},
+		{acceptLanguage: "de-CH, de;q=0.8, en;q=0.5", want: "de-CH"},
+		{acceptLanguage: "en;q=0.5, es", want: "es"},
+		{acceptLanguage: "*", want: ""},
+		{acceptLanguage: "*, it", want: "it"},
+		{acceptLanguage: "not;;valid", want: ""},
+		{lang: "not a language", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := answerLanguage(tt.lang, tt.acceptLanguage)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("answerLanguage(%q, %q) = %q, want error", tt.lang, tt.acceptLanguage, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("answerLanguage(%q, %q) = %q, %v; want %q", tt.lang, tt.acceptLanguage, got, err, tt.want)
+		}
+	}
+}
+
+func TestLanguageInstruction(t *testing.T) {
+	for lang, want := range map[string]string{
+		"fr":    "Answer in French.",
+		"pt-BR": "Answer in Brazilian Portuguese.",
+		"ja":    "Answer in Japanese.",
+	} {
+		if got := languageInstruction(lang); got != want {
+			t.Errorf("languageInstruction(%q) = %q, want %q", lang, got, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// setupLogging installs the default slog logger: LOG_FORMAT=text or json,
+// at LOG_LEVEL (debug, info, warn or error). Logs go to stderr so they
+// never mix with the JSON the CLI subcommands print.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOr("LOG_LEVEL", "info"))); err != nil {
+		fatal("invalid LOG_LEVEL", "error", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format := envOr("LOG_FORMAT", "text"); format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		fatal("invalid LOG_FORMAT: must be text or json", "value", format)
+	}
+	slog.SetDefault(slog.New(requestHandler{h}))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestHandler adds the request ID and bank of the request a log call's
+// context belongs to, so anything logged with one of the *Context
+// functions can be tied to its access log line.
+type requestHandler struct {
+	slog.Handler
+}
+
+func (h requestHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		r.AddAttrs(slog.String("request_id", info.id))
+		if info.bankID != "" {
+			r.AddAttrs(slog.String("bank_id", info.bankID))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestHandler) WithGroup(name string) slog.Handler {
+	return requestHandler{h.Handler.WithGroup(name)}
+}
@@ -1,248 +1,2998 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	hindsight "github.com/vectorize-io/hindsight-client-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/sync/errgroup"
 )
 
-var client *hindsight.APIClient
+// healthProbeTimeout bounds the backend probe made by /health.
+const healthProbeTimeout = 2 * time.Second
+
+// maxIdempotencyKeyLen caps the Idempotency-Key header of /learn.
+const maxIdempotencyKeyLen = 255
+
+var (
+	// storeInteractions is the default for AskRequest.StoreInteraction
+	// (ASK_STORE_INTERACTIONS). Stored interactions get interactionContext
+	// (ASK_INTERACTION_CONTEXT) and interactionTags (ASK_INTERACTION_TAGS)
+	// plus the request's own tags.
+	storeInteractions  = true
+	interactionContext = "Q&A interaction"
+	interactionTags    []string
+
+	// requireFacts is the default for AskRequest.RequireFacts
+	// (REQUIRE_FACTS). An ask that recalls nothing is then answered with
+	// noFactsAnswer (NO_FACTS_ANSWER) instead of reflecting.
+	requireFacts  = false
+	noFactsAnswer = "I don't have information about that."
+
+	// defaultTags (DEFAULT_TAGS) are added to every learned item and stored
+	// interaction, unless the request sets default_tags to false
+	defaultTags []string
+
+	// maxBodyBytes caps JSON request bodies (MAX_BODY_BYTES); maxContentChars
+	// caps each learned content string (MAX_CONTENT_CHARS) and maxTags the
+	// tags on each learned item (MAX_TAGS)
+	maxBodyBytes    int64 = 1 << 20
+	maxContentChars       = 50000
+	maxTags               = 20
+
+	// maxTokensLimit is the largest max_tokens a request may ask for
+	// (MAX_TOKENS_LIMIT)
+	maxTokensLimit int32 = 8192
+
+	// Handler deadlines: askTimeout (ASK_TIMEOUT) covers /ask, /ask/batch,
+	// /query, /preview-ask, /replay, /summary and /debug/reflect,
+	// recallTimeout (RECALL_TIMEOUT) /recall, /recall/batch and
+	// /debug/recall, and learnTimeout (LEARN_TIMEOUT) /learn, /feedback and
+	// bank mission updates
+	askTimeout    = 60 * time.Second
+	recallTimeout = 30 * time.Second
+	learnTimeout  = 30 * time.Second
+
+	// streamTimeout (STREAM_TIMEOUT) replaces the server's read and write
+	// timeouts for responses streamed over a long time: /ask as SSE, /export
+	// and /import
+	streamTimeout = 10 * time.Minute
+)
 
 func main() {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			fatal("loading CONFIG_FILE", "error", err)
+		}
+	}
+	setupLogging()
+	svc, apiURL := setupService()
+
+	// A subcommand runs once against hindsight instead of starting the server
+	if len(os.Args) > 1 {
+		os.Exit(svc.runCommand(os.Args[1], os.Args[2:]))
+	}
+	serve(svc, apiURL)
+}
+
+// setupService builds the Service and the settings shared by the server and
+// the CLI subcommands from the environment. It also returns the configured
+// HINDSIGHT_API_URL.
+func setupService() (*Service, string) {
 	apiURL := envOr("HINDSIGHT_API_URL", "http://localhost:8888")
+	serverURLs := splitList(apiURL)
+	if len(serverURLs) == 0 {
+		fatal("invalid HINDSIGHT_API_URL", "value", apiURL)
+	}
+
+	apiKey := envOr("HINDSIGHT_API_KEY", "")
+	client, err := newSDKClient(serverURLs, apiKey)
+	if err != nil {
+		fatal("configuring the hindsight client", "error", err)
+	}
+	svc := newService(client)
+	// /debug/hindsight probes each server on its own, bypassing failover
+	svc.backends = []backend{{url: serverURLs[0], api: client}}
+	if len(serverURLs) > 1 {
+		svc.backends = svc.backends[:0]
+		for _, u := range serverURLs {
+			probe, err := newSDKClient([]string{u}, apiKey)
+			if err != nil {
+				fatal("configuring the hindsight client", "error", err)
+			}
+			svc.backends = append(svc.backends, backend{url: u, api: probe})
+		}
+	}
+	maxRetries = envInt("HINDSIGHT_MAX_RETRIES", maxRetries)
+	n := envInt("MAX_INFLIGHT", cap(inflight))
+	if n < 1 {
+		fatal("invalid MAX_INFLIGHT: must be positive", "value", n)
+	}
+	inflight = make(chan struct{}, n)
+	inflightWait = envDuration("INFLIGHT_WAIT", inflightWait)
+	breaker.threshold = envInt("BREAKER_THRESHOLD", breaker.threshold)
+	breaker.cooldown = envDuration("BREAKER_COOLDOWN", breaker.cooldown)
+	svc.banks.ttl = envDuration("BANK_CACHE_TTL", svc.banks.ttl)
+	svc.stats.ttl = envDuration("STATS_CACHE_TTL", svc.stats.ttl)
+	svc.answers.ttl = envDuration("ASK_CACHE_TTL", svc.answers.ttl)
+	svc.answers.size = envInt("ASK_CACHE_SIZE", svc.answers.size)
+	svc.learns.ttl = envDuration("IDEMPOTENCY_TTL", svc.learns.ttl)
+	svc.learns.size = envInt("IDEMPOTENCY_CACHE_SIZE", svc.learns.size)
+	svc.recent.window = envDuration("LEARN_DEDUPE_WINDOW", svc.recent.window)
+	svc.recent.size = envInt("LEARN_DEDUPE_CACHE_SIZE", svc.recent.size)
+	svc.bankSettings.path = envOr("BANK_SETTINGS_FILE", "")
+	if svc.bankSettings.path != "" {
+		if err := svc.bankSettings.load(); err != nil {
+			fatal("loading BANK_SETTINGS_FILE", "error", err)
+		}
+	}
+	storeInteractions = envBool("ASK_STORE_INTERACTIONS", storeInteractions)
+	requireFacts = envBool("REQUIRE_FACTS", requireFacts)
+	noFactsAnswer = envOr("NO_FACTS_ANSWER", noFactsAnswer)
+	expandQueries = envBool("EXPAND_QUERY", expandQueries)
+	interactionContext = envOr("ASK_INTERACTION_CONTEXT", interactionContext)
+	callbackAllowedHosts = splitList(strings.ToLower(envOr("CALLBACK_ALLOWED_HOSTS", "")))
+	askReflectMode = envOr("ASK_REFLECT_MODE", askReflectMode)
+	if err := validReflectMode(askReflectMode); err != nil {
+		fatal("invalid ASK_REFLECT_MODE", "error", err)
+	}
+	loadRecallQueryConfig()
+	maxBodyBytes = int64(envInt("MAX_BODY_BYTES", int(maxBodyBytes)))
+	maxContentChars = envInt("MAX_CONTENT_CHARS", maxContentChars)
+	maxTags = envInt("MAX_TAGS", maxTags)
+	if defaultTags, err = normalizeTags(splitList(envOr("DEFAULT_TAGS", ""))); err != nil {
+		fatal("invalid DEFAULT_TAGS", "error", err)
+	}
+	if interactionTags, err = normalizeTags(splitList(envOr("ASK_INTERACTION_TAGS", ""))); err != nil {
+		fatal("invalid ASK_INTERACTION_TAGS", "error", err)
+	}
+	tokenLimit := envInt("MAX_TOKENS_LIMIT", int(maxTokensLimit))
+	if tokenLimit < 1 || tokenLimit > math.MaxInt32 {
+		fatal("invalid MAX_TOKENS_LIMIT: must be positive", "value", tokenLimit)
+	}
+	maxTokensLimit = int32(tokenLimit)
+	askTimeout = envDuration("ASK_TIMEOUT", askTimeout)
+	streamTimeout = envDuration("STREAM_TIMEOUT", streamTimeout)
+	recallTimeout = envDuration("RECALL_TIMEOUT", recallTimeout)
+	learnTimeout = envDuration("LEARN_TIMEOUT", learnTimeout)
+	background.workers = envInt("BACKGROUND_WORKERS", background.workers)
+	if background.workers < 1 {
+		fatal("invalid BACKGROUND_WORKERS: must be positive", "value", background.workers)
+	}
+	background.size = max(envInt("BACKGROUND_QUEUE", background.size), 0)
+	background.stuckAfter = envDuration("BACKGROUND_STUCK_AFTER", background.stuckAfter)
+	learnJobs.workers = envInt("LEARN_ASYNC_WORKERS", learnJobs.workers)
+	if learnJobs.workers < 1 {
+		fatal("invalid LEARN_ASYNC_WORKERS: must be positive", "value", learnJobs.workers)
+	}
+	learnJobs.size = max(envInt("LEARN_ASYNC_QUEUE", learnJobs.size), 0)
+	learnJobs.ttl = envDuration("JOB_TTL", learnJobs.ttl)
+
+	bankPrefix = strings.ToLower(envOr("BANK_PREFIX", bankPrefix))
+	for _, c := range bankPrefix {
+		if !validUserIDChar(c) {
+			fatal("invalid BANK_PREFIX: only letters, digits, '.', '_' and '-' are allowed", "value", bankPrefix)
+		}
+	}
+	tenantRequired = envBool("TENANT_REQUIRED", tenantRequired)
 
-	// Configure the client
-	cfg := hindsight.NewConfiguration()
-	cfg.Servers = hindsight.ServerConfigurations{
-		{URL: apiURL},
+	bankNameTemplate = envOr("BANK_NAME_TEMPLATE", bankNameTemplate)
+	bankMissionTemplate = envOr("BANK_MISSION_TEMPLATE", bankMissionTemplate)
+	for key, tmpl := range map[string]string{
+		"BANK_NAME_TEMPLATE":    bankNameTemplate,
+		"BANK_MISSION_TEMPLATE": bankMissionTemplate,
+	} {
+		if err := validateTemplate(key, tmpl); err != nil {
+			fatal("invalid template", "error", err)
+		}
 	}
-	client = hindsight.NewAPIClient(cfg)
+	return svc, apiURL
+}
 
+// routes registers the service's API routes for svc. Process-wide routes
+// like /metrics are added by serve.
+func routes(svc *Service, limiter *rateLimiter, authToken string) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /ask", handleAsk)
-	mux.HandleFunc("POST /learn", handleLearn)
-	mux.HandleFunc("GET /recall/{userID}", handleRecall)
-	mux.HandleFunc("GET /health", handleHealth)
+	mux.HandleFunc("POST /ask", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(askTimeout, svc.handleAsk))))
+	mux.HandleFunc("POST /ask/batch", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(askTimeout, svc.handleAskBatch))))
+	mux.HandleFunc("POST /query", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(askTimeout, svc.handleQuery))))
+	mux.HandleFunc("POST /preview-ask", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(askTimeout, svc.handlePreviewAsk))))
+	mux.HandleFunc("POST /replay/{userID}", withRateLimit(limiter, withTimeout(askTimeout, svc.handleReplay)))
+	mux.HandleFunc("POST /learn", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(learnTimeout, svc.handleLearn))))
+	mux.HandleFunc("POST /learn/async", withBodyLimit(maxBodyBytes, withRateLimit(limiter, svc.handleLearnAsync)))
+	mux.HandleFunc("GET /jobs/{jobID}", handleJob)
+	mux.HandleFunc("GET /recall/{userID}", withRateLimit(limiter, withTimeout(recallTimeout, svc.handleRecall)))
+	if authToken != "" {
+		mux.HandleFunc("POST /recall/batch", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(recallTimeout, svc.handleRecallBatch))))
+		mux.HandleFunc("POST /debug/recall", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(recallTimeout, svc.handleDebugRecall))))
+		mux.HandleFunc("POST /debug/reflect", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(askTimeout, svc.handleDebugReflect))))
+		mux.HandleFunc("POST /admin/cache/clear", withBodyLimit(maxBodyBytes, svc.handleClearCache))
+		mux.HandleFunc("GET /debug/config", svc.handleDebugConfig)
+		mux.HandleFunc("POST /bank/merge", withBodyLimit(maxBodyBytes, withRateLimit(limiter, svc.handleMergeBanks)))
+	}
+	mux.HandleFunc("DELETE /forget/{userID}", withRateLimit(limiter, svc.handleForget))
+	mux.HandleFunc("DELETE /memory/{userID}/{memoryID}", withRateLimit(limiter, svc.handleDeleteMemory))
+	mux.HandleFunc("GET /summary/{userID}", withRateLimit(limiter, withTimeout(askTimeout, svc.handleSummary)))
+	mux.HandleFunc("GET /stats/{userID}", withRateLimit(limiter, svc.handleStats))
+	mux.HandleFunc("GET /export/{userID}", withRateLimit(limiter, svc.handleExport))
+	mux.HandleFunc("POST /import/{userID}", withRateLimit(limiter, svc.handleImport))
+	mux.HandleFunc("GET /banks", svc.handleBanks)
+	mux.HandleFunc("PUT /bank/{userID}/mission", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(learnTimeout, svc.handleUpdateMission))))
+	mux.HandleFunc("GET /bank/{userID}/settings", withRateLimit(limiter, svc.handleBankSettings))
+	if authToken != "" {
+		mux.HandleFunc("PUT /bank/{userID}/settings", withBodyLimit(maxBodyBytes, withRateLimit(limiter, svc.handleUpdateBankSettings)))
+	}
+	mux.HandleFunc("POST /feedback", withBodyLimit(maxBodyBytes, withRateLimit(limiter, withTimeout(learnTimeout, svc.handleFeedback))))
+	mux.HandleFunc("GET /health", svc.handleHealth)
+	mux.HandleFunc("GET /livez", handleLivez)
+	mux.HandleFunc("GET /debug/hindsight", svc.handleDebugHindsight)
+	mux.HandleFunc("GET /debug/background", handleDebugBackground)
+	return mux
+}
+
+// serve runs the HTTP server until SIGINT or SIGTERM, then drains in-flight
+// requests and background tasks.
+func serve(svc *Service, apiURL string) {
+	// Per-user token buckets; RATE_LIMIT_RPS=0 disables limiting
+	var limiter *rateLimiter
+	if rps := envFloat("RATE_LIMIT_RPS", 10); rps > 0 {
+		limiter = newRateLimiter(rps, envInt("RATE_LIMIT_BURST", 20))
+	}
+
+	authToken := envOr("SERVICE_AUTH_TOKEN", "")
+	if authToken == "" {
+		slog.Info("SERVICE_AUTH_TOKEN is unset, so POST /recall/batch, /debug/recall, /debug/reflect, /debug/config, /admin/cache/clear, /bank/merge and PUT /bank/{userID}/settings are disabled")
+	}
+
+	mux := routes(svc, limiter, authToken)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	if envBool("ENABLE_PPROF", false) {
+		// Profiles expose memory contents and stack traces, and a CPU profile
+		// costs a little throughput while it runs
+		slog.Warn("pprof enabled under /debug/pprof/; keep this port private or set SERVICE_AUTH_TOKEN")
+		registerPprof(mux)
+	}
 
 	addr := envOr("ADDR", ":8080")
-	log.Printf("listening on %s (hindsight: %s)", addr, apiURL)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	overrides := make(map[string]http.Handler)
+	for u, o := range backendOverrides(svc) {
+		overrides[u] = routes(o, limiter, authToken)
+	}
+	handler := withCORS(splitList(envOr("CORS_ALLOWED_ORIGINS", "")), withAuth(authToken, withBackendOverride(overrides, mux)))
+	handler = withRequestLog(withTracing(withMetrics(withGzip(withRecover(handler)))))
+	if envBool("ENABLE_H2C", false) {
+		// HTTP/2 without TLS, for proxies that speak it to their backends;
+		// HTTP/1.1 clients are still served
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	// Generous enough for the handler deadlines, tight enough that slow or
+	// idle clients can't hold connections open indefinitely
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", time.Minute),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 90*time.Second),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 2*time.Minute),
+	}
+	if srv.WriteTimeout > 0 && srv.WriteTimeout <= max(askTimeout, recallTimeout, learnTimeout) {
+		slog.Warn("WRITE_TIMEOUT is not longer than the handler timeouts; slow requests will be cut off without an error response", "write_timeout", srv.WriteTimeout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		fatal("setting up tracing", "error", err)
+	}
+
+	if limiter != nil {
+		go limiter.cleanup(ctx, time.Minute)
+	}
+	if interval := envDuration("REENSURE_INTERVAL", 0); interval > 0 {
+		go svc.reensureBanks(ctx, interval)
+	}
+	if interval := envDuration("EXPIRY_SWEEP_INTERVAL", 0); interval > 0 {
+		go svc.sweepExpired(ctx, interval)
+	}
+	startupTimeout := envDuration("STARTUP_TIMEOUT", 0)
+
+	// Every setting has been read by now
+	warnUnknownSettings()
+	logSettings()
+
+	// Don't take traffic until hindsight answers, or STARTUP_TIMEOUT passes
+	if startupTimeout > 0 && !svc.waitForBackend(ctx, startupTimeout) {
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("hindsight still unreachable, starting anyway", "waited", startupTimeout)
+	}
+
+	go func() {
+		slog.Info("listening", "addr", addr, "hindsight", apiURL)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("serving", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down, waiting for in-flight work", "timeout", shutdownTimeout)
+
+	// In-flight handlers and background tasks share one grace deadline
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown", "error", err)
+	}
+	if err := background.wait(shutdownCtx); err != nil {
+		status := background.status()
+		slog.Error("background tasks did not finish", "error", err, "queued", status.Queued, "running", status.Running)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("tracing shutdown", "error", err)
+	}
 }
 
 // --- Request/Response types ---
 
 type AskRequest struct {
-	UserID string `json:"user_id"`
-	Query  string `json:"query"`
+	UserID    string `json:"user_id"`
+	Query     string `json:"query"`
+	Budget    string `json:"budget,omitempty"`     // low, mid or high; defaults to mid
+	MaxTokens int32  `json:"max_tokens,omitempty"` // recall token limit; see recallMaxTokens
+	// StoreInteraction controls whether the Q&A is retained as a new memory;
+	// defaults to ASK_STORE_INTERACTIONS
+	StoreInteraction *bool `json:"store_interaction,omitempty"`
+	// CallbackURL, if set, receives a RetainCallback once the interaction
+	// has been stored (or failed to be)
+	CallbackURL string `json:"callback_url,omitempty"`
+	// ReflectMode is with_facts or independent; defaults to ASK_REFLECT_MODE
+	ReflectMode string `json:"reflect_mode,omitempty"`
+	// Tags are attached to the stored interaction, after ASK_INTERACTION_TAGS.
+	// Once validated, they include ASK_INTERACTION_TAGS
+	Tags []string `json:"tags,omitempty"`
+	// Lang is the language tag to answer in, or "auto"; defaults to the
+	// Accept-Language header, then auto
+	Lang string `json:"lang,omitempty"`
+	// DefaultTags set to false leaves DEFAULT_TAGS off the stored interaction
+	DefaultTags *bool `json:"default_tags,omitempty"`
+	// RequireFacts answers NO_FACTS_ANSWER without reflecting when recall
+	// finds nothing; defaults to REQUIRE_FACTS
+	RequireFacts *bool `json:"require_facts,omitempty"`
 }
 
 type AskResponse struct {
 	Answer string   `json:"answer"`
 	Facts  []string `json:"facts,omitempty"`
+	// FactCount is how many facts recall found; with require_facts, zero
+	// means Answer is NO_FACTS_ANSWER rather than reflect's
+	FactCount int `json:"fact_count"`
+	// FactsDetailed is only included with ?detailed=true
+	FactsDetailed []RecallFact `json:"facts_detailed,omitempty"`
+	// Sources is only included with ?verbose=true, and only when reflect
+	// reports the facts it based the answer on
+	Sources []ReflectSource `json:"sources,omitempty"`
+	// ExpandedQuery is the query recall was given when EXPAND_QUERY changed
+	// it; only included with ?verbose=true
+	ExpandedQuery string `json:"expanded_query,omitempty"`
+}
+
+// ReflectSource is a fact reflect based its answer on.
+type ReflectSource struct {
+	ID      string `json:"id,omitempty"`
+	Text    string `json:"text"`
+	Type    string `json:"type,omitempty"`
+	Context string `json:"context,omitempty"`
+}
+
+// askOptions selects the optional parts of an ask response: FactsDetailed
+// (?detailed=true) and Sources (?verbose=true).
+type askOptions struct {
+	detailed bool
+	verbose  bool
+	// ensureBank is set by handlers that create the bank before asking, so
+	// a bank hindsight reports missing is ensured again
+	ensureBank bool
+}
+
+func askOptionsFor(r *http.Request) askOptions {
+	q := r.URL.Query()
+	return askOptions{detailed: q.Get("detailed") == "true", verbose: q.Get("verbose") == "true"}
+}
+
+// omitFacts reports whether ?include_facts=false asked to leave the facts
+// out of an ask response, to save bandwidth. They are still recalled and
+// given to reflect, and fact_count is kept.
+func omitFacts(r *http.Request) bool {
+	return r.URL.Query().Get("include_facts") == "false"
+}
+
+// QueryRequest is the body of /query: an /ask without side effects.
+type QueryRequest struct {
+	UserID    string `json:"user_id"`
+	Query     string `json:"query"`
+	Budget    string `json:"budget,omitempty"`
+	MaxTokens int32  `json:"max_tokens,omitempty"`
+	Lang      string `json:"lang,omitempty"`
+}
+
+type QueryResponse struct {
+	Facts  []string `json:"facts"`
+	Answer string   `json:"answer"`
+	// FactsDetailed is only included with ?detailed=true
+	FactsDetailed []RecallFact `json:"facts_detailed,omitempty"`
+	// Sources is only included with ?verbose=true
+	Sources []ReflectSource `json:"sources,omitempty"`
+}
+
+type AskBatchRequest struct {
+	UserID           string   `json:"user_id"`
+	Queries          []string `json:"queries"`
+	Budget           string   `json:"budget,omitempty"`
+	MaxTokens        int32    `json:"max_tokens,omitempty"`
+	StoreInteraction *bool    `json:"store_interaction,omitempty"`
+	ReflectMode      string   `json:"reflect_mode,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	Lang             string   `json:"lang,omitempty"`
+	DefaultTags      *bool    `json:"default_tags,omitempty"`
+	RequireFacts     *bool    `json:"require_facts,omitempty"`
+}
+
+// AskBatchResult is one answer from /ask/batch. Error is set, and the
+// answer and facts are empty, if that query failed.
+type AskBatchResult struct {
+	Query string `json:"query"`
+	AskResponse
+	Error *ErrorDetail `json:"error,omitempty"`
 }
 
 type LearnRequest struct {
-	UserID  string   `json:"user_id"`
-	Content string   `json:"content"`
+	UserID  string      `json:"user_id"`
+	Content string      `json:"content"`
+	Tags    []string    `json:"tags,omitempty"`
+	Context string      `json:"context,omitempty"` // provenance, e.g. "onboarding"; applies to items without their own
+	Items   []LearnItem `json:"items,omitempty"`
+	// DefaultTags set to false leaves out DEFAULT_TAGS
+	DefaultTags *bool `json:"default_tags,omitempty"`
+	// TTLSeconds or ExpiresAt (RFC 3339) make every memory stored by the
+	// request expire; see expiryTagPrefix
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	// Importance, 1 to 5, applies to items without their own
+	Importance int `json:"importance,omitempty"`
+	// Chunk splits the content and each item into chunks of at most
+	// ChunkSize characters, each stored as its own memory
+	Chunk     bool `json:"chunk,omitempty"`
+	ChunkSize int  `json:"chunk_size,omitempty"`
+}
+
+// LearnItem is one memory in a bulk /learn call.
+type LearnItem struct {
+	Content    string   `json:"content"`
+	Tags       []string `json:"tags,omitempty"`
+	Context    string   `json:"context,omitempty"`
+	Importance int      `json:"importance,omitempty"`
+}
+
+// FeedbackRequest marks a recalled fact as helpful or wrong. Helpful is
+// required, so a missing field is never read as "wrong".
+type FeedbackRequest struct {
+	UserID   string `json:"user_id"`
+	FactText string `json:"fact_text"`
+	Helpful  *bool  `json:"helpful"`
+}
+
+// ExportedMemory is one entry of a /export dump.
+type ExportedMemory struct {
+	Text    string   `json:"text"`
+	Type    string   `json:"type"`
 	Tags    []string `json:"tags,omitempty"`
+	Context string   `json:"context,omitempty"`
 }
 
 type RecallResponse struct {
 	Results []RecallFact `json:"results"`
+	Total   int          `json:"total"`
+	HasMore bool         `json:"has_more"`
+	// ExpandedQuery is only included with ?verbose=true, when EXPAND_QUERY
+	// changed the query
+	ExpandedQuery string `json:"expanded_query,omitempty"`
+}
+
+// RecallBatchRequest is the body of /recall/batch: one query recalled for
+// several users.
+type RecallBatchRequest struct {
+	UserIDs []string `json:"user_ids"`
+	Query   string   `json:"query"`
+	Budget  string   `json:"budget,omitempty"` // defaults to high, as for /recall
+	Tags    []string `json:"tags,omitempty"`
+	Limit   int      `json:"limit,omitempty"` // facts per user; defaults to 20
+}
+
+// RecallBatchResult is one user's part of a /recall/batch response. Error
+// is set, and Results empty, if that user's recall failed.
+type RecallBatchResult struct {
+	BankID  string       `json:"bank_id,omitempty"`
+	Results []RecallFact `json:"results"`
+	Total   int          `json:"total"`
+	Error   *ErrorDetail `json:"error,omitempty"`
 }
 
+// RecallFact is one recall result. Hindsight returns results ranked by
+// relevance but without a per-result score, so callers should rely on the
+// order of results rather than a confidence value.
 type RecallFact struct {
-	Text string `json:"text"`
-	Type string `json:"type"`
+	ID         string   `json:"id"` // pass to DELETE /memory/{userID}/{memoryID}
+	Text       string   `json:"text"`
+	Type       string   `json:"type"`
+	Tags       []string `json:"tags,omitempty"`
+	Importance int      `json:"importance"`
+	// MentionedAt is when hindsight recorded the fact, in RFC 3339
+	MentionedAt string `json:"mentioned_at,omitempty"`
+	// Highlight is an excerpt of Text with the query's words in **bold**,
+	// computed here with ?highlight=true since recall reports no match
+	// offsets
+	Highlight string `json:"highlight,omitempty"`
+}
+
+// MemoryStats counts a user's memories. Untyped memories are counted under
+// "unknown" in ByType; a memory with several tags counts once per tag.
+type MemoryStats struct {
+	Total  int            `json:"total"`
+	ByType map[string]int `json:"by_type"`
+	ByTag  map[string]int `json:"by_tag"`
+}
+
+// BackendStatus is the result of probing one hindsight server.
+type BackendStatus struct {
+	ServerURL  string  `json:"server_url"`
+	Reachable  bool    `json:"reachable"`
+	LatencyMS  float64 `json:"latency_ms"`
+	StatusCode int     `json:"status_code,omitempty"`
+	Version    string  `json:"version,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type BanksResponse struct {
+	Banks      []BankInfo `json:"banks"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type BankInfo struct {
+	BankID  string `json:"bank_id"`
+	Name    string `json:"name"`
+	Mission string `json:"mission"`
+}
+
+// UpdateMissionRequest replaces a bank's mission and, if Name is set, its
+// name.
+type UpdateMissionRequest struct {
+	Mission string `json:"mission"`
+	Name    string `json:"name,omitempty"`
+}
+
+// registerPprof adds the net/http/pprof handlers under /debug/pprof/.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
 }
 
 // --- Handlers ---
 
-// handleLearn stores new information for a user.
-func handleLearn(w http.ResponseWriter, r *http.Request) {
+// handleLearn stores new information for a user. With ?dry_run=true it
+// validates the request and reports what would be stored without
+// retaining anything.
+func (s *Service) handleLearn(w http.ResponseWriter, r *http.Request) {
 	var req LearnRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
+	if !decodeLearn(w, r, &req) {
+		return
+	}
+
+	// The single content, if any, goes first, followed by the bulk items
+	learnItems := slices.Clone(req.Items)
+	if req.Content != "" {
+		learnItems = append([]LearnItem{{Content: req.Content, Tags: req.Tags, Importance: req.Importance}}, learnItems...)
+	}
+	if len(learnItems) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "content or items required")
+		return
+	}
+	expires, err := learnExpiry(req.TTLSeconds, req.ExpiresAt, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	// Chunks keep their item's tags, context and importance
+	chunks := 0
+	if req.Chunk {
+		size, err := validChunkSize(req.ChunkSize)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		chunked := make([]LearnItem, 0, len(learnItems))
+		for i, li := range learnItems {
+			if li.Content == "" {
+				writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("item %d: content required", i))
+				return
+			}
+			for _, chunk := range chunkText(li.Content, size) {
+				li.Content = chunk
+				chunked = append(chunked, li)
+			}
+		}
+		if len(chunked) == 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request", "content or items required")
+			return
+		}
+		learnItems = chunked
+		chunks = len(chunked)
+	} else if req.ChunkSize != 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "chunk_size needs chunk")
+		return
+	}
+	for i := range learnItems {
+		if learnItems[i].Content == "" {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("item %d: content required", i))
+			return
+		}
+		if n := utf8.RuneCountInString(learnItems[i].Content); n > maxContentChars {
+			writeError(w, http.StatusBadRequest, "content_too_long", fmt.Sprintf("item %d: content is %d characters, limit is %d", i, n, maxContentChars))
+			return
+		}
+		tags, err := normalizeTags(learnItems[i].Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("item %d: %v", i, err))
+			return
+		}
+		learnItems[i].Tags = withDefaultTags(tags, req.DefaultTags)
+		if !expires.IsZero() {
+			learnItems[i].Tags = append(learnItems[i].Tags, expiryTag(expires))
+		}
+		learnItems[i].Context = cmp.Or(learnItems[i].Context, req.Context)
+		learnItems[i].Importance = cmp.Or(learnItems[i].Importance, req.Importance)
+		if err := validImportance(learnItems[i].Importance); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("item %d: %v", i, err))
+			return
+		}
+	}
+
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
 		return
 	}
 
 	ctx := r.Context()
-	bankID := bankFor(req.UserID)
+	annotateBank(ctx, bankID)
 
-	// Ensure bank exists
-	ensureBank(ctx, bankID, req.UserID)
+	// A dry run validates and checks the bank without creating or storing anything
+	if r.URL.Query().Get("dry_run") == "true" {
+		exists, httpResp, err := s.bankExists(ctx, bankID)
+		if err != nil {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+
+		writeJSON(w, map[string]any{
+			"dry_run":     true,
+			"bank_id":     bankID,
+			"bank_exists": exists,
+			"items":       learnItems,
+		})
+		return
+	}
+
+	// A repeated Idempotency-Key replays the original response instead of
+	// storing the content again. Keys are scoped to the bank.
+	idemKey := r.Header.Get("Idempotency-Key")
+	if len(idemKey) > maxIdempotencyKeyLen {
+		writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Idempotency-Key is longer than %d characters", maxIdempotencyKeyLen))
+		return
+	}
+	if idemKey != "" && s.learns.enabled() {
+		idemKey = bankID + " " + idemKey
+		prev, busy := s.learns.claim(idemKey)
+		if busy {
+			writeError(w, http.StatusConflict, "idempotency_conflict", "a request with this Idempotency-Key is still in progress")
+			return
+		}
+		if prev != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, prev)
+			return
+		}
+		// A no-op once complete has stored the response
+		defer s.learns.release(idemKey)
+	}
+	respond := func(result map[string]any) {
+		if idemKey != "" && s.learns.enabled() {
+			s.learns.complete(idemKey, result)
+		}
+		writeJSON(w, result)
+	}
 
-	// Store the memory
-	item := hindsight.MemoryItem{
-		Content: req.Content,
+	// Content retained recently, or repeated within the request, is skipped
+	// rather than stored twice
+	duplicates := 0
+	if s.recent.enabled() {
+		fresh := make([]LearnItem, 0, len(learnItems))
+		for _, li := range learnItems {
+			if s.recent.seen(bankID, li.Content) || slices.ContainsFunc(fresh, func(f LearnItem) bool { return f.Content == li.Content }) {
+				duplicates++
+				continue
+			}
+			fresh = append(fresh, li)
+		}
+		learnItems = fresh
+	}
+	if len(learnItems) == 0 {
+		result := map[string]any{
+			"success":           true,
+			"bank_id":           bankID,
+			"retained":          0,
+			"skipped_duplicate": true,
+			"duplicates":        duplicates,
+		}
+		if req.Chunk {
+			result["chunks"] = chunks
+		}
+		respond(result)
+		return
 	}
-	if len(req.Tags) > 0 {
-		item.Tags = req.Tags
+
+	// Ensure bank exists
+	s.ensureBank(ctx, bankID, req.UserID)
+
+	// Store the memories in a single retain call
+	items := make([]hindsight.MemoryItem, 0, len(learnItems))
+	for _, li := range learnItems {
+		item := hindsight.MemoryItem{
+			Content:  li.Content,
+			Metadata: importanceMetadata(li.Importance),
+		}
+		if len(li.Tags) > 0 {
+			item.Tags = li.Tags
+		}
+		if li.Context != "" {
+			item.Context = *hindsight.NewNullableString(hindsight.PtrString(li.Context))
+		}
+		items = append(items, item)
 	}
 
 	retainReq := hindsight.RetainRequest{
-		Items: []hindsight.MemoryItem{item},
+		Items: items,
 	}
 
-	resp, httpResp, err := client.MemoryAPI.RetainMemories(ctx, bankID).RetainRequest(retainReq).Execute()
+	resp, httpResp, err := s.api.Retain(ctx, bankID, retainReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeHindsightError(w, httpResp, err)
 		return
 	}
 	defer httpResp.Body.Close()
+	retained := retainedCount(resp, len(items))
+	if retained == 0 {
+		writeError(w, http.StatusBadGateway, "upstream_error", "hindsight stored none of the items")
+		return
+	}
+	// New memories may change cached answers
+	s.answers.invalidate(bankID)
+	s.stats.forget(bankID)
+	// With a partial retain there's no telling which items were stored, so
+	// none are remembered
+	if s.recent.enabled() && retained == len(items) {
+		contents := make([]string, len(learnItems))
+		for i, li := range learnItems {
+			contents[i] = li.Content
+		}
+		s.recent.add(bankID, contents)
+	}
 
-	writeJSON(w, map[string]any{
-		"success": resp.GetSuccess(),
-		"bank_id": bankID,
-	})
+	// The retain response carries no memory IDs: hindsight extracts facts from
+	// each item, possibly several, and assigns IDs to those. Callers find
+	// them through /recall or /export instead.
+	result := map[string]any{
+		"success":  resp.GetSuccess(),
+		"bank_id":  bankID,
+		"retained": retained,
+	}
+	if retained < len(items) {
+		result["partial"] = true
+		result["failed"] = len(items) - retained
+	}
+	if duplicates > 0 {
+		result["skipped_duplicate"] = true
+		result["duplicates"] = duplicates
+	}
+	if req.Chunk {
+		result["chunks"] = chunks
+	}
+	respond(result)
 }
 
-// handleAsk answers a question using the user's memories.
-func handleAsk(w http.ResponseWriter, r *http.Request) {
+// handleAsk answers a question using the user's memories. With
+// Accept: text/event-stream the recalled facts are sent as a "facts" event
+// as soon as recall finishes, followed by an "answer" event once reflect
+// completes (or an "error" event if it fails).
+func (s *Service) handleAsk(w http.ResponseWriter, r *http.Request) {
 	var req AskRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	budget, err := parseBudget(req.Budget)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+		return
+	}
+	if err := validMaxTokens(req.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	req.Lang, err = answerLanguage(req.Lang, r.Header.Get("Accept-Language"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
+	if err := validReflectMode(req.ReflectMode); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+	if req.Tags, err = normalizeTags(slices.Concat(interactionTags, req.Tags)); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	budget, req.MaxTokens = s.bankSettings.get(bankID).applyTo(req.Budget, budget, req.MaxTokens)
 
 	ctx := r.Context()
-	bankID := bankFor(req.UserID)
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, budget)
 
 	// Ensure bank exists
-	ensureBank(ctx, bankID, req.UserID)
+	s.ensureBank(ctx, bankID, req.UserID)
 
-	// Recall relevant facts
-	recallReq := hindsight.RecallRequest{
-		Query:     req.Query,
-		Budget:    hindsight.MID.Ptr(),
-		MaxTokens: hindsight.PtrInt32(2048),
+	// Stream the facts as soon as recall finishes, while reflect is running.
+	// Streams need their own recall, so only plain asks are coalesced.
+	opts := askOptionsFor(r)
+	opts.ensureBank = true
+	var stream *eventStream
+	var resp AskResponse
+	if wantsEventStream(r) {
+		extendDeadlines(w, streamTimeout)
+		resp, err = s.ask(ctx, bankID, req, budget, opts, func(facts AskResponse) {
+			if omitFacts(r) {
+				facts.Facts = nil
+			}
+			stream = newEventStream(w)
+			stream.send("facts", facts)
+		})
+	} else if req.CallbackURL != "" {
+		// Each callback belongs to one caller, so these are never shared
+		resp, err = s.ask(ctx, bankID, req, budget, opts, nil)
+	} else {
+		resp, err = s.askShared(ctx, bankID, req, budget, opts)
 	}
-
-	recallResp, httpResp, err := client.MemoryAPI.RecallMemories(ctx, bankID).RecallRequest(recallReq).Execute()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpResp, err := splitCallError(err)
+		if stream != nil {
+			_, detail := hindsightError(httpResp, err)
+			stream.send("error", ErrorResponse{Error: detail})
+			return
+		}
+		writeHindsightError(w, httpResp, err)
 		return
 	}
-	defer httpResp.Body.Close()
 
-	var facts []string
-	for _, result := range recallResp.Results {
-		facts = append(facts, result.GetText())
+	if stream != nil {
+		stream.send("answer", map[string]any{"answer": resp.Answer})
+		return
 	}
 
-	// Reflect to generate an answer
-	reflectReq := hindsight.ReflectRequest{
-		Query:  req.Query,
-		Budget: hindsight.MID.Ptr(),
+	if wantsPlainText(r) {
+		writeText(w, resp.Answer)
+		return
+	}
+
+	if omitFacts(r) {
+		resp.Facts = nil
 	}
+	writeJSON(w, resp)
+}
 
-	reflectResp, httpResp2, err := client.MemoryAPI.Reflect(ctx, bankID).ReflectRequest(reflectReq).Execute()
+// handleQuery recalls facts and then reflects on them, returning both. It
+// is a side-effect-free /ask: the bank is never created and the
+// interaction is never stored.
+func (s *Service) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "query is required")
+		return
+	}
+	budget, err := parseBudget(req.Budget)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+		return
+	}
+	if err := validMaxTokens(req.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	req.Lang, err = answerLanguage(req.Lang, r.Header.Get("Accept-Language"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
-	defer httpResp2.Body.Close()
-
-	// Store this interaction as a new memory
-	interaction := fmt.Sprintf("User asked: %q\nAssistant answered: %s", req.Query, reflectResp.GetText())
-	go func() {
-		bgCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		retainReq := hindsight.RetainRequest{
-			Items: []hindsight.MemoryItem{{
-				Content: interaction,
-				Context: *hindsight.NewNullableString(hindsight.PtrString("Q&A interaction")),
-			}},
-		}
-		client.MemoryAPI.RetainMemories(bgCtx, bankID).RetainRequest(retainReq).Execute()
-	}()
-
-	writeJSON(w, AskResponse{
-		Answer: reflectResp.GetText(),
-		Facts:  facts,
-	})
-}
 
-// handleRecall returns raw memories for a user.
-func handleRecall(w http.ResponseWriter, r *http.Request) {
-	userID := r.PathValue("userID")
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		query = "What do you know?"
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
 	}
 
 	ctx := r.Context()
-	bankID := bankFor(userID)
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, budget)
 
-	recallReq := hindsight.RecallRequest{
-		Query:  query,
-		Budget: hindsight.HIGH.Ptr(),
+	exists, httpResp, err := s.bankExists(ctx, bankID)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "bank_not_found", "no memories have been stored for this user")
+		return
 	}
 
-	resp, httpResp, err := client.MemoryAPI.RecallMemories(ctx, bankID).RecallRequest(recallReq).Execute()
+	// With facts, reflect only starts once recall has finished
+	store := false
+	resp, err := s.askShared(ctx, bankID, AskRequest{
+		UserID:           req.UserID,
+		Query:            req.Query,
+		MaxTokens:        req.MaxTokens,
+		StoreInteraction: &store,
+		ReflectMode:      reflectWithFacts,
+		Lang:             req.Lang,
+	}, budget, askOptionsFor(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpResp, err := splitCallError(err)
+		writeHindsightError(w, httpResp, err)
 		return
 	}
-	defer httpResp.Body.Close()
 
-	var results []RecallFact
-	for _, result := range resp.Results {
-		resultType := "unknown"
-		if t := result.GetType(); t != "" {
-			resultType = t
-		}
-		results = append(results, RecallFact{
-			Text: result.GetText(),
-			Type: resultType,
-		})
+	facts := resp.Facts
+	if facts == nil {
+		facts = []string{}
 	}
-
-	writeJSON(w, RecallResponse{Results: results})
-}
-
-func handleHealth(w http.ResponseWriter, _ *http.Request) {
-	writeJSON(w, map[string]string{"status": "ok"})
+	writeJSON(w, QueryResponse{Facts: facts, Answer: resp.Answer, FactsDetailed: resp.FactsDetailed, Sources: resp.Sources})
 }
 
-// --- Helpers ---
-
-func bankFor(userID string) string {
-	return "user-" + strings.ToLower(userID)
+// ask runs recall and reflect for req.Query against bankID and, unless
+// opted out, stores the interaction in the background. onFacts, if not nil,
+// is called with the recalled facts as soon as recall succeeds, before
+// reflect has necessarily finished. Failures are returned as *callError.
+//
+// With opts.ensureBank, a bank hindsight reports missing, because creating
+// it failed or it was deleted since it was last ensured, is ensured again
+// and the ask retried once. If the bank is still missing the error is
+// errBankUnavailable.
+func (s *Service) ask(ctx context.Context, bankID string, req AskRequest, budget hindsight.Budget, opts askOptions, onFacts func(AskResponse)) (AskResponse, error) {
+	if !opts.ensureBank {
+		return s.askOnce(ctx, bankID, req, budget, opts, onFacts)
+	}
+	// A retry may recall again, but the caller hears about facts only once
+	if onFacts != nil {
+		notify := onFacts
+		sent := false
+		onFacts = func(facts AskResponse) {
+			if !sent {
+				sent = true
+				notify(facts)
+			}
+		}
+	}
+	resp, err := s.askOnce(ctx, bankID, req, budget, opts, onFacts)
+	if !isBankNotFound(err) {
+		return resp, err
+	}
+	slog.WarnContext(ctx, "bank missing after it was ensured, ensuring it again", "bank_id", bankID)
+	s.banks.forget(bankID)
+	s.ensureBank(ctx, bankID, req.UserID)
+	resp, err = s.askOnce(ctx, bankID, req, budget, opts, onFacts)
+	if isBankNotFound(err) {
+		return AskResponse{}, &callError{err: errBankUnavailable}
+	}
+	return resp, err
 }
 
-func ensureBank(ctx context.Context, bankID, userID string) {
-	createReq := hindsight.CreateBankRequest{
-		Name:    *hindsight.NewNullableString(hindsight.PtrString(fmt.Sprintf("Memory for %s", userID))),
-		Mission: *hindsight.NewNullableString(hindsight.PtrString("Developer knowledge assistant. Remember technologies, problems solved, and preferences.")),
+// askOnce is ask without the retry for a missing bank.
+func (s *Service) askOnce(ctx context.Context, bankID string, req AskRequest, budget hindsight.Budget, opts askOptions, onFacts func(AskResponse)) (AskResponse, error) {
+	// Recall relevant facts
+	recallReq := hindsight.RecallRequest{
+		Query:     req.Query,
+		Budget:    budget.Ptr(),
+		MaxTokens: hindsight.PtrInt32(recallMaxTokens(req.MaxTokens)),
 	}
 
-	_, httpResp, err := client.BanksAPI.CreateOrUpdateBank(ctx, bankID).CreateBankRequest(createReq).Execute()
-	if err != nil {
-		// Bank might already exist, which is fine
-		return
+	// Reflect to generate an answer
+	reflectReq := hindsight.ReflectRequest{
+		Query:  req.Query,
+		Budget: budget.Ptr(),
 	}
-	if httpResp != nil {
-		defer httpResp.Body.Close()
+	if req.Lang != "" {
+		reflectReq.Query = languageInstruction(req.Lang) + "\n\n" + req.Query
+	}
+	if opts.verbose {
+		reflectReq.Include = &hindsight.ReflectIncludeOptions{Facts: &hindsight.FactsIncludeOptions{}}
 	}
-}
 
-func writeJSON(w http.ResponseWriter, v any) {
+	// Run both concurrently. Independent reflects don't use the recall
+	// results; with facts, reflect waits for recall and is given its facts as
+	// context. Requiring facts, reflect waits for recall too, and is skipped
+	// if it found nothing. The group context cancels the other call if one
+	// fails or the client leaves.
+	withFacts := cmp.Or(req.ReflectMode, askReflectMode) == reflectWithFacts
+	needFacts := shouldRequireFacts(req)
+	g, gctx := errgroup.WithContext(ctx)
+
+	var recallResp *hindsight.RecallResponse
+	recallDone := make(chan error, 1)
+	factsReady := make(chan struct{})
+	g.Go(func() error {
+		recallReq.Query = s.expandQuery(gctx, bankID, normalizeQuery(req.Query))
+		resp, httpResp, err := s.api.Recall(gctx, bankID, recallReq)
+		if err != nil {
+			err = &callError{httpResp: httpResp, err: err}
+		} else {
+			httpResp.Body.Close()
+			rankByImportance(resp.Results)
+			recallResp = resp
+			close(factsReady)
+		}
+		recallDone <- err
+		return err
+	})
+
+	var reflectResp *hindsight.ReflectResponse
+	g.Go(func() error {
+		if withFacts || needFacts {
+			select {
+			case <-factsReady:
+			case <-gctx.Done():
+				return &callError{err: gctx.Err()}
+			}
+			if needFacts && len(recallResp.Results) == 0 {
+				return nil
+			}
+		}
+		if withFacts {
+			reflectReq.Context = *hindsight.NewNullableString(hindsight.PtrString(factsContext(recallResp.Results)))
+		}
+		resp, httpResp, err := s.api.Reflect(gctx, bankID, reflectReq)
+		if err != nil {
+			return &callError{httpResp: httpResp, err: err}
+		}
+		httpResp.Body.Close()
+		reflectResp = resp
+		return nil
+	})
+
+	var result AskResponse
+	if err := <-recallDone; err == nil {
+		result.FactCount = len(recallResp.Results)
+		for _, fact := range recallResp.Results {
+			result.Facts = append(result.Facts, fact.GetText())
+			if opts.detailed {
+				result.FactsDetailed = append(result.FactsDetailed, newRecallFact(fact))
+			}
+		}
+		if opts.verbose && recallReq.Query != normalizeQuery(req.Query) {
+			result.ExpandedQuery = recallReq.Query
+		}
+		if onFacts != nil {
+			onFacts(result)
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return AskResponse{}, err
+	}
+	// A nil response means reflect was skipped for want of facts
+	result.Answer = noFactsAnswer
+	if reflectResp != nil {
+		result.Answer = reflectResp.GetText()
+	}
+	if opts.verbose && reflectResp != nil {
+		for _, fact := range reflectResp.GetBasedOn() {
+			result.Sources = append(result.Sources, ReflectSource{
+				ID:      fact.GetId(),
+				Text:    fact.GetText(),
+				Type:    fact.GetType(),
+				Context: fact.GetContext(),
+			})
+		}
+	}
+
+	// Store this interaction as a new memory, unless opted out
+	if shouldStore(req) {
+		interaction := formatInteraction(req.Query, result.Answer)
+		background.run(ctx, "store interaction", func() {
+			// Detached from the request's cancellation but keeps its request ID
+			bgCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+			defer cancel()
+
+			item := hindsight.MemoryItem{
+				Content:  interaction,
+				Context:  *hindsight.NewNullableString(hindsight.PtrString(interactionContext)),
+				Metadata: interactionMetadata(req.Query, result.Answer),
+			}
+			if tags := withDefaultTags(req.Tags, req.DefaultTags); len(tags) > 0 {
+				item.Tags = tags
+			}
+			retainReq := hindsight.RetainRequest{Items: []hindsight.MemoryItem{item}}
+			_, httpResp, err := s.api.Retain(bgCtx, bankID, retainReq)
+			if err == nil {
+				httpResp.Body.Close()
+			}
+
+			if req.CallbackURL != "" {
+				payload := RetainCallback{BankID: bankID, Success: err == nil}
+				if err != nil {
+					_, detail := hindsightError(httpResp, err)
+					payload.Error = detail.Message
+				}
+				cbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+				defer cancel()
+				notifyCallback(cbCtx, req.CallbackURL, payload)
+			}
+		})
+	}
+
+	return result, nil
+}
+
+// Reflect modes for /ask (ASK_REFLECT_MODE, or reflect_mode per request).
+const (
+	reflectWithFacts   = "with_facts"
+	reflectIndependent = "independent"
+)
+
+// askReflectMode is the default reflect mode. With facts, the recalled facts
+// are passed to reflect as context, so the answer rests on what /ask
+// returns as facts, at the cost of running reflect after recall rather than
+// alongside it. Independent reflects gather their own context.
+var askReflectMode = reflectWithFacts
+
+func validReflectMode(mode string) error {
+	switch mode {
+	case "", reflectWithFacts, reflectIndependent:
+		return nil
+	}
+	return fmt.Errorf("invalid reflect_mode %q: use %s or %s", mode, reflectWithFacts, reflectIndependent)
+}
+
+// factsContext renders recalled facts as reflect context.
+func factsContext(results []hindsight.RecallResult) string {
+	var b strings.Builder
+	b.WriteString("Facts recalled for this question:")
+	for _, result := range results {
+		b.WriteString("\n- ")
+		b.WriteString(result.GetText())
+	}
+	return b.String()
+}
+
+// askShared is ask for callers that don't stream facts. Answers come from
+// the answer cache when enabled, and identical concurrent asks (same bank,
+// query and options) share one backend computation and all receive its
+// answer. The shared call is detached from the callers' cancellation and
+// bounded by askTimeout instead, but each caller still stops waiting, and
+// gets its own context error, when its context ends.
+func (s *Service) askShared(ctx context.Context, bankID string, req AskRequest, budget hindsight.Budget, opts askOptions) (AskResponse, error) {
+	query := strings.ToLower(strings.Join(strings.Fields(normalizeQuery(req.Query)), " "))
+	mode := cmp.Or(req.ReflectMode, askReflectMode)
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%+v\x00%t\x00%s\x00%q\x00%s\x00%t", bankID, query, budget, req.MaxTokens, opts, shouldStore(req), mode, req.Tags, req.Lang, shouldRequireFacts(req))
+
+	var gen uint64
+	if s.answers.enabled() {
+		resp, g, ok := s.answers.get(bankID, key)
+		if ok {
+			return resp, nil
+		}
+		gen = g
+	}
+
+	ch := s.asks.DoChan(key, func() (any, error) {
+		sharedCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), askTimeout)
+		defer cancel()
+		resp, err := s.ask(sharedCtx, bankID, req, budget, opts, nil)
+		if err == nil && s.answers.enabled() {
+			s.answers.put(bankID, key, gen, resp)
+		}
+		return resp, err
+	})
+
+	select {
+	case res := <-ch:
+		return res.Val.(AskResponse), res.Err
+	case <-ctx.Done():
+		return AskResponse{}, &callError{err: ctx.Err()}
+	}
+}
+
+// shouldRequireFacts reports whether an ask that recalls nothing skips
+// reflect.
+func shouldRequireFacts(req AskRequest) bool {
+	if req.RequireFacts != nil {
+		return *req.RequireFacts
+	}
+	return requireFacts
+}
+
+// shouldStore reports whether an ask's interaction is retained as a memory.
+func shouldStore(req AskRequest) bool {
+	if req.StoreInteraction != nil {
+		return *req.StoreInteraction
+	}
+	return storeInteractions
+}
+
+// handleAskBatch answers several questions for one user. Queries run
+// concurrently, at most askBatchConcurrency at a time, and results come
+// back in request order. A failed query reports its own error instead of
+// failing the batch.
+func (s *Service) handleAskBatch(w http.ResponseWriter, r *http.Request) {
+	var req AskBatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Queries) == 0 || len(req.Queries) > maxBatchQueries {
+		writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("queries must contain 1 to %d questions", maxBatchQueries))
+		return
+	}
+
+	budget, err := parseBudget(req.Budget)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+		return
+	}
+	if err := validMaxTokens(req.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	req.Lang, err = answerLanguage(req.Lang, r.Header.Get("Accept-Language"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := validReflectMode(req.ReflectMode); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if req.Tags, err = normalizeTags(slices.Concat(interactionTags, req.Tags)); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	budget, req.MaxTokens = s.bankSettings.get(bankID).applyTo(req.Budget, budget, req.MaxTokens)
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, budget)
+
+	// Ensure bank exists
+	s.ensureBank(ctx, bankID, req.UserID)
+
+	opts := askOptionsFor(r)
+	opts.ensureBank = true
+	results := make([]AskBatchResult, len(req.Queries))
+	var g errgroup.Group
+	g.SetLimit(askBatchConcurrency)
+	for i, query := range req.Queries {
+		g.Go(func() error {
+			results[i].Query = query
+			resp, err := s.askShared(ctx, bankID, AskRequest{
+				UserID:           req.UserID,
+				Query:            query,
+				MaxTokens:        req.MaxTokens,
+				StoreInteraction: req.StoreInteraction,
+				ReflectMode:      req.ReflectMode,
+				Tags:             req.Tags,
+				Lang:             req.Lang,
+				DefaultTags:      req.DefaultTags,
+				RequireFacts:     req.RequireFacts,
+			}, budget, opts)
+			if err != nil {
+				_, detail := hindsightError(splitCallError(err))
+				results[i].Error = &detail
+				return nil
+			}
+			if omitFacts(r) {
+				resp.Facts = nil
+			}
+			results[i].AskResponse = resp
+			return nil
+		})
+	}
+	g.Wait()
+
+	writeJSON(w, map[string]any{
+		"bank_id": bankID,
+		"results": results,
+	})
+}
+
+const (
+	// maxBatchQueries caps the questions in one /ask/batch request, and
+	// askBatchConcurrency how many of them are answered at once.
+	maxBatchQueries     = 20
+	askBatchConcurrency = 4
+)
+
+// defaultSummaryQuery is the reflect prompt /summary uses without ?query=.
+const defaultSummaryQuery = "Summarize everything you know about this user."
+
+// handleSummary reflects over the user's whole bank at a high budget to
+// describe what the system knows about them. Unlike /ask, the exchange is
+// not retained.
+func (s *Service) handleSummary(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	query := cmp.Or(r.URL.Query().Get("query"), defaultSummaryQuery)
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, summaryBudget)
+
+	reflectReq := hindsight.ReflectRequest{
+		Query:  query,
+		Budget: summaryBudget.Ptr(),
+	}
+
+	resp, httpResp, err := s.api.Reflect(ctx, bankID, reflectReq)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if wantsPlainText(r) {
+		writeText(w, resp.GetText())
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"bank_id": bankID,
+		"summary": resp.GetText(),
+	})
+}
+
+// handleFeedback records user feedback on a recalled fact as a new memory
+// tagged "feedback", so future recalls and reflects can take it into account.
+func (s *Service) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	var req FeedbackRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.FactText == "" || req.Helpful == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "fact_text and helpful are required")
+		return
+	}
+
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	// Ensure bank exists
+	s.ensureBank(ctx, bankID, req.UserID)
+
+	note := fmt.Sprintf("The user marked this remembered fact as incorrect or irrelevant: %q", req.FactText)
+	if *req.Helpful {
+		note = fmt.Sprintf("The user confirmed this remembered fact is correct and helpful: %q", req.FactText)
+	}
+
+	retainReq := hindsight.RetainRequest{
+		Items: []hindsight.MemoryItem{{
+			Content: note,
+			Context: *hindsight.NewNullableString(hindsight.PtrString("user feedback")),
+			Tags:    []string{"feedback"},
+		}},
+	}
+
+	_, httpResp, err := s.api.Retain(ctx, bankID, retainReq)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	defer httpResp.Body.Close()
+	s.answers.invalidate(bankID)
+	s.stats.forget(bankID)
+
+	writeJSON(w, map[string]any{
+		"recorded": true,
+		"bank_id":  bankID,
+		"helpful":  *req.Helpful,
+	})
+}
+
+var (
+	// defaultRecallQuery is the query /recall uses without ?q=
+	// (DEFAULT_RECALL_QUERY). With requireRecallQuery (RECALL_REQUIRE_QUERY)
+	// set there is no fallback and ?q= is mandatory.
+	defaultRecallQuery = "What do you know?"
+	requireRecallQuery = false
+
+	// normalizeQueries (NORMALIZE_QUERY) passes queries through
+	// normalizeQuery before recall and the answer cache
+	normalizeQueries = false
+)
+
+func loadRecallQueryConfig() {
+	defaultRecallQuery = envOr("DEFAULT_RECALL_QUERY", defaultRecallQuery)
+	requireRecallQuery = envBool("RECALL_REQUIRE_QUERY", requireRecallQuery)
+	normalizeQueries = envBool("NORMALIZE_QUERY", normalizeQueries)
+}
+
+// recallQuery returns the query for a /recall request, falling back to
+// defaultRecallQuery when ?q= is empty.
+func recallQuery(r *http.Request) (string, error) {
+	if q := r.URL.Query().Get("q"); q != "" {
+		return q, nil
+	}
+	if requireRecallQuery {
+		return "", errors.New("q is required")
+	}
+	return defaultRecallQuery, nil
+}
+
+// normalizeQuery lower-cases query, collapses its whitespace and strips
+// trailing punctuation, so "What's my name?" and "what's my  name" recall
+// alike. It's the identity unless normalizeQueries is set.
+func normalizeQuery(query string) string {
+	if !normalizeQueries {
+		return query
+	}
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	return strings.TrimRightFunc(query, func(r rune) bool { return unicode.IsPunct(r) || unicode.IsSpace(r) })
+}
+
+// handleRecall returns raw memories for a user, optionally scoped to
+// memories carrying any of ?tags=a,b.
+func (s *Service) handleRecall(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	query, err := recallQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	// Recall has no native paging, so ?limit= and ?offset= slice the results
+	limit, err := intParam(r, "limit", 20, 1, 200)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	offset, err := intParam(r, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	// Recall takes no time range either, so ?since= and ?until= filter the
+	// results on when each fact was mentioned
+	since, err := timeParam(r, "since")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	until, err := timeParam(r, "until")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !since.IsZero() && !until.IsZero() && since.After(until) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "since is after until")
+		return
+	}
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	// Direct recall defaults to a high budget rather than parseBudget's mid,
+	// unless the user's settings say otherwise
+	budget, _ := s.bankSettings.get(bankID).applyTo("", defaultRecallBudget, 0)
+	if v := r.URL.Query().Get("budget"); v != "" {
+		budget, err = parseBudget(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+			return
+		}
+	}
+
+	annotateBudget(ctx, budget)
+
+	all, expanded, err := s.recallFacts(ctx, bankID, query, budget, filterTags(splitList(r.URL.Query().Get("tags"))))
+	if err != nil {
+		writeRecallError(w, err)
+		return
+	}
+
+	// ?type= keeps only facts of that type; "unknown" selects untyped facts
+	facts := []RecallFact{}
+	factType := r.URL.Query().Get("type")
+	for _, fact := range all {
+		if factType != "" && !strings.EqualFold(fact.Type, factType) {
+			continue
+		}
+		if !inTimeRange(fact.MentionedAt, since, until) {
+			continue
+		}
+		facts = append(facts, fact)
+	}
+
+	total := len(facts)
+	results := facts[min(offset, total):min(offset+limit, total)]
+	if r.URL.Query().Get("highlight") == "true" {
+		terms := queryTerms(query)
+		for i := range results {
+			results[i].Highlight = highlight(results[i].Text, terms)
+		}
+	}
+
+	page := RecallResponse{
+		Results: results,
+		Total:   total,
+		HasMore: offset+limit < total,
+	}
+	if r.URL.Query().Get("verbose") == "true" {
+		page.ExpandedQuery = expanded
+	}
+	// CSV has no room for the paging fields, so the total goes in a header
+	if wantsCSV(r) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, fact := range results {
+			cw.Write(csvRecord(fact.Text, fact.Type, fact.Tags))
+		}
+		cw.Flush()
+		return
+	}
+	writeJSON(w, page)
+}
+
+// errBankNotFound reports a recall against a user who has never stored
+// anything.
+var errBankNotFound = errors.New("no memories have been stored for this user")
+
+// recallFacts runs a direct recall of query against bankID, limited to
+// memories with any of tags if there are some. It also returns the query
+// recall was given if EXPAND_QUERY expanded it, or "". A bank that doesn't
+// exist fails with errBankNotFound; other failures are *callError.
+func (s *Service) recallFacts(ctx context.Context, bankID, query string, budget hindsight.Budget, tags []string) (facts []RecallFact, expanded string, err error) {
+	query = normalizeQuery(query)
+	recallReq := hindsight.RecallRequest{
+		Query:  s.expandQuery(ctx, bankID, query),
+		Budget: budget.Ptr(),
+	}
+	if len(tags) > 0 {
+		// any_strict: at least one tag must match, and untagged memories are excluded
+		recallReq.Tags = tags
+		recallReq.TagsMatch = hindsight.PtrString("any_strict")
+	}
+
+	resp, httpResp, err := s.api.Recall(ctx, bankID, recallReq)
+	if err != nil {
+		return nil, "", &callError{httpResp: httpResp, err: err}
+	}
+	httpResp.Body.Close()
+	rankByImportance(resp.Results)
+
+	// Recall on a bank that was never created may succeed with no results;
+	// tell that apart from an existing bank with no matches
+	if len(resp.Results) == 0 {
+		exists, httpResp, err := s.bankExists(ctx, bankID)
+		if err != nil {
+			return nil, "", &callError{httpResp: httpResp, err: err}
+		}
+		if !exists {
+			return nil, "", errBankNotFound
+		}
+	}
+
+	facts = make([]RecallFact, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		facts = append(facts, newRecallFact(result))
+	}
+	if recallReq.Query != query {
+		expanded = recallReq.Query
+	}
+	return facts, expanded, nil
+}
+
+const (
+	// maxRecallBatchUsers caps the users in one /recall/batch request, and
+	// recallBatchConcurrency how many of them are recalled at once.
+	maxRecallBatchUsers    = 100
+	recallBatchConcurrency = 8
+)
+
+// handleRecallBatch recalls one query for many users, for admin reports.
+// Users are recalled concurrently and the response maps each user ID to
+// its facts, or to the error its recall failed with. It's only routed when
+// SERVICE_AUTH_TOKEN is set, since it reads across users.
+func (s *Service) handleRecallBatch(w http.ResponseWriter, r *http.Request) {
+	var req RecallBatchRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.UserIDs) == 0 || len(req.UserIDs) > maxRecallBatchUsers {
+		writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("user_ids must contain 1 to %d users", maxRecallBatchUsers))
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "query is required")
+		return
+	}
+	if req.Limit < 0 || req.Limit > 200 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "limit must be between 0 and 200, 0 for the default of 20")
+		return
+	}
+	limit := cmp.Or(req.Limit, 20)
+	budget := defaultRecallBudget
+	if req.Budget != "" {
+		var err error
+		if budget, err = parseBudget(req.Budget); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+			return
+		}
+	}
+
+	ctx := r.Context()
+	annotateBudget(ctx, budget)
+
+	results := make(map[string]*RecallBatchResult, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		results[userID] = &RecallBatchResult{Results: []RecallFact{}}
+	}
+	var g errgroup.Group
+	g.SetLimit(recallBatchConcurrency)
+	for userID, result := range results {
+		bankID, err := bankFor(r.Header.Get("X-Tenant-ID"), userID)
+		if err != nil {
+			result.Error = &ErrorDetail{Code: "invalid_user_id", Message: err.Error()}
+			continue
+		}
+		result.BankID = bankID
+		g.Go(func() error {
+			facts, _, err := s.recallFacts(ctx, bankID, req.Query, budget, filterTags(req.Tags))
+			if err != nil {
+				detail := recallErrorDetail(err)
+				result.Error = &detail
+				return nil
+			}
+			result.Total = len(facts)
+			result.Results = facts[:min(limit, len(facts))]
+			return nil
+		})
+	}
+	g.Wait()
+
+	writeJSON(w, map[string]any{"results": results})
+}
+
+// writeRecallError writes the error response for a recallFacts failure.
+func writeRecallError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBankNotFound) {
+		writeError(w, http.StatusNotFound, "bank_not_found", err.Error())
+		return
+	}
+	httpResp, err := splitCallError(err)
+	writeHindsightError(w, httpResp, err)
+}
+
+// recallErrorDetail is the error detail for a recallFacts failure, for
+// reporting it inline.
+func recallErrorDetail(err error) ErrorDetail {
+	if errors.Is(err, errBankNotFound) {
+		return ErrorDetail{Code: "bank_not_found", Message: err.Error()}
+	}
+	_, detail := hindsightError(splitCallError(err))
+	return detail
+}
+
+// handleForget erases a user's memories. Without ?tag= the whole bank is
+// dropped; with it, only memories carrying that tag are deleted.
+func (s *Service) handleForget(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	// Tags are stored normalized, so the filter is too
+	tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	if tag == "" {
+		_, httpResp, err := s.api.DeleteBank(ctx, bankID)
+		if err != nil {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+		defer httpResp.Body.Close()
+		s.dropBank(ctx, bankID)
+
+		writeJSON(w, map[string]any{
+			"deleted": true,
+			"bank_id": bankID,
+		})
+		return
+	}
+
+	ids, httpResp, err := s.taggedMemoryIDs(ctx, bankID, tag)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+
+	defer s.answers.invalidate(bankID)
+	defer s.stats.forget(bankID)
+	defer s.recent.forget(bankID)
+	for _, id := range ids {
+		_, httpResp, err := s.api.DeleteMemory(ctx, bankID, id)
+		if err != nil {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+		httpResp.Body.Close()
+	}
+
+	writeJSON(w, map[string]any{
+		"deleted":       true,
+		"bank_id":       bankID,
+		"tag":           tag,
+		"deleted_count": len(ids),
+	})
+}
+
+// dropBank forgets everything the service keeps about a bank hindsight
+// deleted.
+func (s *Service) dropBank(ctx context.Context, bankID string) {
+	s.banks.forget(bankID)
+	s.answers.invalidate(bankID)
+	s.stats.forget(bankID)
+	s.recent.forget(bankID)
+	if err := s.bankSettings.set(bankID, BankSettings{}); err != nil {
+		slog.ErrorContext(ctx, "dropping bank settings failed", "error", err)
+	}
+}
+
+// handleDeleteMemory removes a single memory by ID. IDs come from the id
+// field of /recall results.
+func (s *Service) handleDeleteMemory(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	memoryID := r.PathValue("memoryID")
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	_, httpResp, err := s.api.DeleteMemory(ctx, bankID, memoryID)
+	if err != nil {
+		if httpResp != nil && httpResp.StatusCode == http.StatusNotFound {
+			writeError(w, http.StatusNotFound, "memory_not_found", "memory not found")
+			return
+		}
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	defer httpResp.Body.Close()
+	s.answers.invalidate(bankID)
+	s.stats.forget(bankID)
+	// The deleted memory's content can't be told apart, so forget them all
+	s.recent.forget(bankID)
+
+	writeJSON(w, map[string]any{
+		"deleted":   true,
+		"bank_id":   bankID,
+		"memory_id": memoryID,
+	})
+}
+
+// handleExport streams every memory in the user's bank as a JSON array of
+// ExportedMemory, one page at a time, so large banks are never held in
+// memory. If listing fails after the array has started, the body is left
+// truncated (invalid JSON) and the failure is logged.
+func (s *Service) handleExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+	extendDeadlines(w, streamTimeout)
+
+	// Accept: text/csv writes a header row and a row per memory instead of
+	// a JSON array
+	asCSV := wantsCSV(r)
+	enc := json.NewEncoder(w)
+	cw := csv.NewWriter(w)
+	started := false
+	count := 0
+	start := func() error {
+		started = true
+		if asCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, bankID))
+			return cw.Write(csvHeader)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, bankID))
+		_, err := io.WriteString(w, "[\n")
+		return err
+	}
+
+	httpResp, err := s.listMemories(ctx, bankID, func(items []map[string]any) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		for _, item := range items {
+			m := exportedMemory(item)
+			if asCSV {
+				if err := cw.Write(csvRecord(m.Text, m.Type, m.Tags)); err != nil {
+					return err
+				}
+				count++
+				continue
+			}
+			if count > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+			count++
+		}
+		// The CSV writer buffers rows; send on each page as it is read
+		cw.Flush()
+		return cw.Error()
+	})
+	if err != nil {
+		if !started {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+		slog.ErrorContext(ctx, "export aborted", "memories", count, "error", err)
+		return
+	}
+
+	if !started {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	if asCSV {
+		cw.Flush()
+		return
+	}
+	io.WriteString(w, "]\n")
+}
+
+// importBatchSize is how many memories go into each retain during /import.
+const importBatchSize = 50
+
+// handleImport restores a JSON array produced by /export into the user's
+// bank, or with Content-Type application/x-ndjson one memory per line.
+// Entries are decoded one at a time and retained in batches, so the body is
+// never held in memory whole; a failed batch is counted and skipped rather
+// than aborting the import. With ?replace=true the bank is cleared first.
+func (s *Service) handleImport(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	replace := r.URL.Query().Get("replace") == "true"
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+	extendDeadlines(w, streamTimeout)
+
+	dec := json.NewDecoder(r.Body)
+	// next decodes the following entry, returning io.EOF after the last
+	next := dec.Decode
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/x-ndjson" {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			writeError(w, http.StatusBadRequest, "invalid_json", "request body must be a JSON array of memories")
+			return
+		}
+		next = func(v any) error {
+			if !dec.More() {
+				return io.EOF
+			}
+			return dec.Decode(v)
+		}
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	// Ensure bank exists
+	s.ensureBank(ctx, bankID, userID)
+
+	defer s.answers.invalidate(bankID)
+	defer s.stats.forget(bankID)
+	if replace {
+		_, httpResp, err := s.api.ClearMemories(ctx, bankID)
+		if err != nil {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+		httpResp.Body.Close()
+		s.recent.forget(bankID)
+	}
+
+	processed, imported, failed, batches := 0, 0, 0, 0
+	batch := make([]hindsight.MemoryItem, 0, importBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		batches++
+		retainReq := hindsight.RetainRequest{Items: batch}
+		resp, httpResp, err := s.api.Retain(ctx, bankID, retainReq)
+		if err != nil {
+			slog.WarnContext(ctx, "import batch failed", "items", len(batch), "error", err)
+			failed += len(batch)
+		} else {
+			httpResp.Body.Close()
+			n := retainedCount(resp, len(batch))
+			if n < len(batch) {
+				slog.WarnContext(ctx, "import batch partially stored", "items", len(batch), "stored", n)
+			}
+			imported += n
+			failed += len(batch) - n
+		}
+		batch = make([]hindsight.MemoryItem, 0, importBatchSize)
+	}
+
+	for {
+		var m ExportedMemory
+		err := next(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid memory after %d entries: %v", processed, err))
+			return
+		}
+		processed++
+		if m.Text == "" {
+			failed++
+			continue
+		}
+		batch = append(batch, memoryItem(m))
+		if len(batch) == importBatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	writeJSON(w, map[string]any{
+		"bank_id":   bankID,
+		"processed": processed,
+		"imported":  imported,
+		"failed":    failed,
+		"batches":   batches,
+		"replaced":  replace,
+	})
+}
+
+// handleStats counts a user's memories by type and tag. Counting lists the
+// whole bank, so results are cached for STATS_CACHE_TTL.
+func (s *Service) handleStats(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	if stats, ok := s.stats.get(bankID); ok {
+		writeJSON(w, stats)
+		return
+	}
+
+	stats := MemoryStats{ByType: map[string]int{}, ByTag: map[string]int{}}
+	httpResp, err := s.listMemories(ctx, bankID, func(items []map[string]any) error {
+		for _, item := range items {
+			m := exportedMemory(item)
+			stats.Total++
+			stats.ByType[m.Type]++
+			for _, tag := range m.Tags {
+				stats.ByTag[tag]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+
+	// An empty listing may also mean the bank was never created
+	if stats.Total == 0 {
+		exists, httpResp, err := s.bankExists(ctx, bankID)
+		if err != nil {
+			writeHindsightError(w, httpResp, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, "bank_not_found", "no memories have been stored for this user")
+			return
+		}
+	}
+
+	s.stats.put(bankID, stats)
+	writeJSON(w, stats)
+}
+
+// exportedMemory converts a listed memory unit to its export form.
+func exportedMemory(item map[string]any) ExportedMemory {
+	text, _ := item["text"].(string)
+	factType, _ := item["fact_type"].(string)
+	if factType == "" {
+		factType = "unknown"
+	}
+	memContext, _ := item["context"].(string)
+	return ExportedMemory{
+		Text:    text,
+		Type:    factType,
+		Tags:    stringList(item["tags"]),
+		Context: memContext,
+	}
+}
+
+// memoryItem is an exported memory to retain again.
+func memoryItem(m ExportedMemory) hindsight.MemoryItem {
+	item := hindsight.MemoryItem{Content: m.Text, Tags: m.Tags}
+	if m.Context != "" {
+		item.Context = *hindsight.NewNullableString(hindsight.PtrString(m.Context))
+	}
+	return item
+}
+
+// handleBanks lists memory banks, ordered by bank ID. Only this service's
+// banks are listed, those of the request's X-Tenant-ID tenant if it has
+// one, as other deployments and tenants may share the hindsight instance.
+// The hindsight list API returns every bank at once, so ?limit= and
+// ?cursor= are applied here: the cursor is the last bank ID of the previous
+// page.
+func (s *Service) handleBanks(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", 50, 1, 200)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	prefix, err := tenantPrefix(r.Header.Get("X-Tenant-ID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_user_id", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	resp, httpResp, err := s.api.ListBanks(ctx)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	all := resp.GetBanks()
+	sort.Slice(all, func(i, j int) bool { return all[i].GetBankId() < all[j].GetBankId() })
+
+	banks := []BankInfo{}
+	var next string
+	for _, b := range all {
+		if !strings.HasPrefix(b.GetBankId(), prefix) || b.GetBankId() <= cursor {
+			continue
+		}
+		if len(banks) == limit {
+			next = banks[len(banks)-1].BankID
+			break
+		}
+		banks = append(banks, BankInfo{
+			BankID:  b.GetBankId(),
+			Name:    b.GetName(),
+			Mission: b.GetMission(),
+		})
+	}
+
+	writeJSON(w, BanksResponse{Banks: banks, NextCursor: next})
+}
+
+// handleUpdateMission replaces the mission of the user's bank, creating the
+// bank if it doesn't exist yet. The mission shapes reflect, so cached
+// answers for the bank are dropped. The mission and name are kept in the
+// bank's settings, so re-ensuring the bank keeps them.
+func (s *Service) handleUpdateMission(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+
+	var req UpdateMissionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Mission = strings.TrimSpace(req.Mission)
+	if req.Mission == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "mission is required")
+		return
+	}
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+
+	createReq := hindsight.CreateBankRequest{
+		Mission: *hindsight.NewNullableString(hindsight.PtrString(req.Mission)),
+	}
+	name := strings.TrimSpace(req.Name)
+	if name != "" {
+		createReq.Name = *hindsight.NewNullableString(hindsight.PtrString(name))
+	}
+
+	resp, httpResp, err := s.api.CreateOrUpdateBank(ctx, bankID, createReq)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	defer httpResp.Body.Close()
+	s.banks.touch(bankID, userID)
+	s.answers.invalidate(bankID)
+	s.stats.forget(bankID)
+
+	settings := s.bankSettings.get(bankID)
+	settings.Mission = req.Mission
+	if name != "" {
+		settings.Name = name
+	}
+	if err := s.bankSettings.set(bankID, settings); err != nil {
+		// The bank has the mission, it just won't survive a re-ensure
+		slog.ErrorContext(ctx, "saving bank mission failed", "path", s.bankSettings.path, "error", err)
+	}
+
+	writeJSON(w, BankInfo{
+		BankID:  bankID,
+		Name:    resp.GetName(),
+		Mission: resp.GetMission(),
+	})
+}
+
+// handleHealth reports readiness by probing the hindsight backend with a
+// cheap version call. It returns 503 with status "degraded" when the
+// backend is unreachable.
+func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthProbeTimeout)
+	defer cancel()
+
+	_, httpResp, err := s.api.Version(ctx)
+	if err != nil {
+		_, detail := hindsightError(httpResp, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSONBody(w, map[string]string{
+			"status": "degraded",
+			"error":  detail.Message,
+		})
+		return
+	}
+	defer httpResp.Body.Close()
+
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleDebugHindsight probes every configured hindsight server with a
+// version call and reports whether each answered and how fast. Unlike
+// /health it always returns 200, so it can't affect readiness.
+func (s *Service) handleDebugHindsight(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]BackendStatus, len(s.backends))
+	var wg sync.WaitGroup
+	for i, b := range s.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = b.probe(r.Context())
+		}()
+	}
+	wg.Wait()
+
+	writeJSON(w, map[string]any{"servers": statuses, "breaker": breaker.status()})
+}
+
+// ConfigResponse is the body of /debug/config.
+type ConfigResponse struct {
+	Settings map[string]SettingValue `json:"settings"`
+	// HindsightURLs are the servers calls go to, HINDSIGHT_API_URL parsed
+	HindsightURLs []string `json:"hindsight_urls"`
+	// Budgets are the defaults for requests without a budget, by endpoint
+	Budgets map[string]hindsight.Budget `json:"budgets"`
+}
+
+// handleDebugConfig reports the configuration the process is running with:
+// the effective value of every setting it read, with secrets redacted, so a
+// setting that isn't taking effect can be told from one that was never
+// read. Settings are read at startup, so changes to the environment or
+// CONFIG_FILE since then don't show.
+func (s *Service) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	urls := make([]string, len(s.backends))
+	for i, b := range s.backends {
+		urls[i] = b.url
+	}
+	writeJSON(w, ConfigResponse{
+		Settings:      settingsSnapshot(),
+		HindsightURLs: urls,
+		Budgets: map[string]hindsight.Budget{
+			"ask":     defaultAskBudget,
+			"recall":  defaultRecallBudget,
+			"summary": summaryBudget,
+		},
+	})
+}
+
+// DebugRequest is the body of /debug/recall and /debug/reflect: a user
+// and a hindsight request sent for their bank as is.
+type DebugRequest[T any] struct {
+	UserID  string `json:"user_id"`
+	Request T      `json:"request"`
+}
+
+// handleDebugRecall sends a hindsight recall request unchanged and returns
+// hindsight's whole decoded response, including the fields /recall drops.
+func (s *Service) handleDebugRecall(w http.ResponseWriter, r *http.Request) {
+	var req DebugRequest[hindsight.RecallRequest]
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	annotateBank(r.Context(), bankID)
+
+	resp, httpResp, err := s.api.Recall(r.Context(), bankID, req.Request)
+	writeDebugResponse(w, bankID, resp, httpResp, err)
+}
+
+// handleDebugReflect is handleDebugRecall for reflect.
+func (s *Service) handleDebugReflect(w http.ResponseWriter, r *http.Request) {
+	var req DebugRequest[hindsight.ReflectRequest]
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	bankID, ok := requestBank(w, r, req.UserID)
+	if !ok {
+		return
+	}
+	annotateBank(r.Context(), bankID)
+
+	resp, httpResp, err := s.api.Reflect(r.Context(), bankID, req.Request)
+	writeDebugResponse(w, bankID, resp, httpResp, err)
+}
+
+// writeDebugResponse writes a passed-through hindsight response along with
+// the bank and HTTP status it came from. Failures are reported as for any
+// other route, without the raw client error.
+func writeDebugResponse(w http.ResponseWriter, bankID string, resp any, httpResp *http.Response, err error) {
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	httpResp.Body.Close()
+	writeJSON(w, map[string]any{
+		"bank_id":     bankID,
+		"status_code": httpResp.StatusCode,
+		"response":    resp,
+	})
+}
+
+// ClearCacheRequest is the body of /admin/cache/clear. Which is "all" (the
+// default) or one of the caches in clearCache.
+type ClearCacheRequest struct {
+	Which string `json:"which,omitempty"`
+}
+
+// handleClearCache empties the in-process caches, e.g. after hindsight's
+// data was migrated or restored behind the service's back, and returns how
+// many entries each held. Only this replica's caches are cleared.
+func (s *Service) handleClearCache(w http.ResponseWriter, r *http.Request) {
+	var req ClearCacheRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	which := cmp.Or(req.Which, "all")
+
+	caches := map[string]func() int{
+		"banks":       s.banks.clear,
+		"answers":     s.answers.clear,
+		"stats":       s.stats.clear,
+		"idempotency": s.learns.clear,
+		"dedupe":      s.recent.clear,
+	}
+	cleared := make(map[string]int)
+	for name, empty := range caches {
+		if which == "all" || which == name {
+			cleared[name] = empty()
+		}
+	}
+	if len(cleared) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", `which must be "all", "banks", "answers", "stats", "idempotency" or "dedupe"`)
+		return
+	}
+	slog.InfoContext(r.Context(), "caches cleared", "which", which, "cleared", cleared)
+
+	writeJSON(w, map[string]any{"cleared": cleared})
+}
+
+// waitForBackend probes hindsight with version calls, backing off between
+// attempts, until one succeeds or timeout passes. It reports whether
+// hindsight answered.
+func (s *Service) waitForBackend(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		probeCtx, probeCancel := context.WithTimeout(ctx, healthProbeTimeout)
+		_, httpResp, err := s.api.Version(probeCtx)
+		probeCancel()
+		if err == nil {
+			httpResp.Body.Close()
+			slog.Info("hindsight reachable", "attempts", attempt)
+			return true
+		}
+		slog.Info("waiting for hindsight", "attempt", attempt, "retry_in", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// handleLivez is a liveness check that never touches the backend.
+func handleLivez(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// --- Helpers ---
+
+// inTimeRange reports whether the RFC 3339 time at is within [since, until],
+// where a zero bound is open. With either bound set, facts without a
+// parseable time are left out.
+func inTimeRange(at string, since, until time.Time) bool {
+	if since.IsZero() && until.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return false
+	}
+	return !t.Before(since) && (until.IsZero() || !t.After(until))
+}
+
+// newRecallFact converts a hindsight recall result, labelling untyped
+// results "unknown".
+func newRecallFact(result hindsight.RecallResult) RecallFact {
+	resultType := "unknown"
+	if t := result.GetType(); t != "" {
+		resultType = t
+	}
+	return RecallFact{
+		ID:          result.GetId(),
+		Text:        result.GetText(),
+		Type:        resultType,
+		Tags:        result.GetTags(),
+		Importance:  resultImportance(result),
+		MentionedAt: result.GetMentionedAt(),
+	}
+}
+
+// bankPrefix starts every bank ID (BANK_PREFIX), so deployments sharing a
+// hindsight instance can keep their banks apart.
+var bankPrefix = "user-"
+
+// tenantRequired makes X-Tenant-ID mandatory (TENANT_REQUIRED). Without it,
+// a deployment that mixes tenanted and untenanted requests should keep user
+// IDs free of '-', since "a-b" without a tenant and user "b" in tenant "a"
+// share a bank.
+var tenantRequired = false
+
+// bankFor derives the bank ID for a user, optionally within a tenant: the
+// result is <prefix><userID>, or <prefix><tenant>-<userID> with a tenant.
+// User IDs are case-insensitive and may only contain [a-z0-9._-] once
+// lowercased, so distinct IDs can never map to the same bank (e.g. "A/B" is
+// rejected rather than folded into "a-b"). Tenants are validated the same
+// way but may not contain '-', which separates them from the user ID.
+func bankFor(tenant, userID string) (string, error) {
+	id := strings.ToLower(userID)
+	if id == "" {
+		return "", errors.New("user_id is required")
+	}
+	for _, c := range id {
+		if !validUserIDChar(c) {
+			return "", fmt.Errorf("invalid user_id %q: only letters, digits, '.', '_' and '-' are allowed", userID)
+		}
+	}
+
+	prefix, err := tenantPrefix(tenant)
+	if err != nil {
+		return "", err
+	}
+	return prefix + id, nil
+}
+
+// tenantPrefix returns what starts the bank IDs of a tenant's users:
+// <prefix>, or <prefix><tenant>- with a tenant.
+func tenantPrefix(tenant string) (string, error) {
+	if tenant == "" {
+		if tenantRequired {
+			return "", errors.New("X-Tenant-ID is required")
+		}
+		return bankPrefix, nil
+	}
+	t := strings.ToLower(tenant)
+	for _, c := range t {
+		if c == '-' || !validUserIDChar(c) {
+			return "", fmt.Errorf("invalid tenant %q: only letters, digits, '.' and '_' are allowed", tenant)
+		}
+	}
+	return bankPrefix + t + "-", nil
+}
+
+// requestBank derives the bank for userID in the request's X-Tenant-ID
+// tenant, writing a 400 if either is invalid. It reports whether a bank was
+// derived.
+func requestBank(w http.ResponseWriter, r *http.Request, userID string) (string, bool) {
+	bankID, err := bankFor(r.Header.Get("X-Tenant-ID"), userID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_user_id", err.Error())
+		return "", false
+	}
+	return bankID, true
+}
+
+func validUserIDChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// Bank name and mission templates (BANK_NAME_TEMPLATE,
+// BANK_MISSION_TEMPLATE). {userID} is replaced with the user's ID.
+var (
+	bankNameTemplate    = "Memory for {userID}"
+	bankMissionTemplate = "Developer knowledge assistant. Remember technologies, problems solved, and preferences."
+)
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateTemplate rejects templates using any placeholder but {userID}.
+func validateTemplate(envKey, tmpl string) error {
+	for _, p := range placeholderPattern.FindAllString(tmpl, -1) {
+		if p != "{userID}" {
+			return fmt.Errorf("%s: unknown placeholder %s (only {userID} is supported)", envKey, p)
+		}
+	}
+	return nil
+}
+
+func renderTemplate(tmpl, userID string) string {
+	return strings.ReplaceAll(tmpl, "{userID}", userID)
+}
+
+// bankExists reports whether bankID has been created. A 404 from hindsight
+// means it doesn't exist; any other failure is returned as an error.
+func (s *Service) bankExists(ctx context.Context, bankID string) (bool, *http.Response, error) {
+	_, httpResp, err := s.api.GetBankProfile(ctx, bankID)
+	if err != nil {
+		if httpResp != nil && httpResp.StatusCode == http.StatusNotFound {
+			return false, nil, nil
+		}
+		return false, httpResp, err
+	}
+	httpResp.Body.Close()
+	return true, nil, nil
+}
+
+// ensureBank creates the bank if it doesn't exist. Existing banks keep
+// their name and mission, so a mission set through
+// PUT /bank/{userID}/mission sticks. Banks ensured within the cache TTL are
+// skipped without a network round-trip.
+func (s *Service) ensureBank(ctx context.Context, bankID, userID string) {
+	s.banks.touch(bankID, userID)
+	s.banks.do(ctx, bankID, func() bool {
+		exists, httpResp, err := s.bankExists(ctx, bankID)
+		if err != nil {
+			if httpResp != nil {
+				httpResp.Body.Close()
+			}
+			return false
+		}
+		return exists || s.createBank(ctx, bankID, userID)
+	})
+}
+
+// reensureBanks re-runs CreateOrUpdateBank every interval for each bank used
+// during the previous interval, so bank names and missions converge on the
+// current templates, except those set through PUT /bank/{userID}/mission.
+// Calls are spread across the interval with jitter. It returns when ctx is
+// done.
+func (s *Service) reensureBanks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-ticker.C:
+			banks := s.banks.recent(tick.Add(-interval))
+			for bankID, userID := range banks {
+				// Each wait is random in [0, interval/n), so a pass over n
+				// banks takes about half the interval
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(rand.N(max(interval/time.Duration(len(banks)), 1))):
+				}
+				s.banks.forget(bankID)
+				s.banks.do(ctx, bankID, func() bool {
+					return s.createBank(ctx, bankID, userID)
+				})
+			}
+		}
+	}
+}
+
+// createBank calls CreateOrUpdateBank and reports whether it succeeded.
+func (s *Service) createBank(ctx context.Context, bankID, userID string) bool {
+	settings := s.bankSettings.get(bankID)
+	createReq := hindsight.CreateBankRequest{
+		Name:    *hindsight.NewNullableString(hindsight.PtrString(cmp.Or(settings.Name, renderTemplate(bankNameTemplate, userID)))),
+		Mission: *hindsight.NewNullableString(hindsight.PtrString(cmp.Or(settings.Mission, renderTemplate(bankMissionTemplate, userID)))),
+	}
+
+	_, httpResp, err := s.api.CreateOrUpdateBank(ctx, bankID, createReq)
+	if err != nil {
+		// Bank might already exist, which is fine
+		return false
+	}
+	if httpResp != nil {
+		defer httpResp.Body.Close()
+	}
+	return true
+}
+
+// normalizeTags trims and lower-cases tags and drops duplicates, keeping
+// the first occurrence's position. It rejects empty tags and more than
+// maxTags distinct ones.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, errors.New("tags must not be empty")
+		}
+		if err := checkReservedTags([]string{tag}); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("%d tags, limit is %d", len(out), maxTags)
+	}
+	return out, nil
+}
+
+// filterTags trims and lower-cases tags to filter by, as normalizeTags does
+// to stored ones, dropping empty tags.
+func filterTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// withDefaultTags appends the defaultTags not already in tags, unless use
+// is set to false.
+func withDefaultTags(tags []string, use *bool) []string {
+	if use != nil && !*use {
+		return tags
+	}
+	for _, tag := range defaultTags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// retainedCount returns how many of the n items sent in a retain were
+// stored. hindsight reports a count rather than a status per item, so a
+// shortfall can't be traced to particular items. An unsuccessful retain
+// counts as storing nothing.
+func retainedCount(resp *hindsight.RetainResponse, n int) int {
+	if !resp.GetSuccess() {
+		return 0
+	}
+	return min(int(resp.GetItemsCount()), n)
+}
+
+// taggedMemoryIDs returns the IDs of every memory in a bank carrying tag.
+// On failure it returns the response of the failed call.
+func (s *Service) taggedMemoryIDs(ctx context.Context, bankID, tag string) ([]string, *http.Response, error) {
+	var ids []string
+	httpResp, err := s.listMemories(ctx, bankID, func(items []map[string]any) error {
+		for _, item := range items {
+			id, _ := item["id"].(string)
+			if id != "" && slices.Contains(stringList(item["tags"]), tag) {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	return ids, httpResp, err
+}
+
+// listMemories pages through every memory in a bank, calling fn with each
+// page. It stops at the first error from fn or from the API, in which case
+// the response of the failed call is returned.
+func (s *Service) listMemories(ctx context.Context, bankID string, fn func(items []map[string]any) error) (*http.Response, error) {
+	const pageSize = 100
+
+	for offset := int32(0); ; offset += pageSize {
+		resp, httpResp, err := s.api.ListMemories(ctx, bankID, pageSize, offset)
+		if err != nil {
+			return httpResp, err
+		}
+		httpResp.Body.Close()
+
+		items := resp.GetItems()
+		if err := fn(items); err != nil {
+			return nil, err
+		}
+		if len(items) < pageSize {
+			return nil, nil
+		}
+	}
+}
+
+// stringList converts a decoded JSON string array, skipping non-strings.
+func stringList(v any) []string {
+	list, _ := v.([]any)
+	var out []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Budgets used when a request doesn't set one and the user's settings have
+// no default_budget, as reported by /debug/config. Answering endpoints use
+// defaultAskBudget, listing facts uses defaultRecallBudget, and /summary
+// always recalls widely.
+const (
+	defaultAskBudget    = hindsight.MID
+	defaultRecallBudget = hindsight.HIGH
+	summaryBudget       = hindsight.HIGH
+)
+
+// parseBudget maps "low", "mid" or "high" (case-insensitive, surrounding
+// whitespace ignored) to a hindsight budget. Empty input means
+// defaultAskBudget.
+func parseBudget(s string) (hindsight.Budget, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return defaultAskBudget, nil
+	case "low":
+		return hindsight.LOW, nil
+	case "mid":
+		return hindsight.MID, nil
+	case "high":
+		return hindsight.HIGH, nil
+	}
+	return "", fmt.Errorf(`invalid budget %q: must be one of "low", "mid", "high"`, s)
+}
+
+// defaultMaxTokens is the recall token limit used when a request sets none.
+const defaultMaxTokens = 2048
+
+// validMaxTokens checks a request's max_tokens, where 0 means unset, so
+// nothing outside [1, maxTokensLimit] reaches hindsight.
+func validMaxTokens(n int32) error {
+	if n < 0 || n > maxTokensLimit {
+		return fmt.Errorf("max_tokens must be between 1 and %d", maxTokensLimit)
+	}
+	return nil
+}
+
+// recallMaxTokens returns the recall token limit for a validated
+// max_tokens, filling in the default when it is unset.
+func recallMaxTokens(n int32) int32 {
+	if n == 0 {
+		return min(defaultMaxTokens, maxTokensLimit)
+	}
+	return n
+}
+
+// intParam reads an integer query parameter, returning def when it is
+// absent and an error when it is malformed or outside [lo, hi].
+func intParam(r *http.Request, name string, def, lo, hi int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be an integer between %d and %d", name, lo, hi)
+	}
+	return n, nil
+}
+
+// timeParam reads an RFC 3339 time query parameter, returning the zero
+// time when it is absent.
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time such as 2024-05-01T00:00:00Z", name)
+	}
+	return t, nil
+}
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// decodeJSON decodes the request body into v, writing a 413 if the body
+// exceeded its limit or a 400 if it isn't valid JSON. It reports whether
+// decoding succeeded.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit))
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "request body must be valid JSON")
+		return false
+	}
+	return true
+}
+
+// decodeLearn reads a /learn body into req. A text/plain body is taken
+// whole as the content, for the user in ?user= with optional ?tags= and
+// ?context=; anything else is decoded as a JSON LearnRequest.
+func decodeLearn(w http.ResponseWriter, r *http.Request, req *LearnRequest) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return decodeJSON(w, r, req)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit))
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+		return false
+	}
+	q := r.URL.Query()
+	*req = LearnRequest{
+		UserID:  q.Get("user"),
+		Content: strings.TrimSpace(string(body)),
+		Tags:    splitList(q.Get("tags")),
+		Context: q.Get("context"),
+	}
+	if q.Get("default_tags") == "false" {
+		req.DefaultTags = new(bool)
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
+	writeJSONBody(w, v)
+}
+
+// wantsPlainText reports whether the client asked for a bare text answer
+// instead of JSON. JSON wins if both are acceptable.
+func wantsPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+// wantsCSV reports whether the client asked for facts as CSV instead of
+// JSON. JSON wins if both are acceptable.
+func wantsCSV(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/csv") && !strings.Contains(accept, "application/json")
+}
+
+// csvHeader names the columns of facts written as CSV by csvRecord.
+var csvHeader = []string{"text", "type", "tags"}
+
+// csvRecord is a fact as a CSV row, its tags joined with commas in one cell.
+// encoding/csv quotes cells holding commas, quotes or newlines.
+func csvRecord(text, factType string, tags []string) []string {
+	return []string{text, factType, strings.Join(tags, ",")}
+}
+
+func writeText(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, text)
+}
+
+func writeJSONBody(w http.ResponseWriter, v any) {
 	json.NewEncoder(w).Encode(v)
 }
 
 func envOr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	v := setting(key)
+	if v == "" {
+		v = fallback
+	}
+	noteSetting(key, v)
+	return v
+}
+
+func envBool(key string, fallback bool) bool {
+	b := fallback
+	if v := setting(key); v != "" {
+		var err error
+		if b, err = strconv.ParseBool(v); err != nil {
+			fatal("invalid setting", "setting", key, "value", v, "error", err)
+		}
+	}
+	noteSetting(key, b)
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	d := fallback
+	if v := setting(key); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			fatal("invalid setting", "setting", key, "value", v, "error", err)
+		}
+	}
+	noteSetting(key, d)
+	return d
+}
+
+func envFloat(key string, fallback float64) float64 {
+	f := fallback
+	if v := setting(key); v != "" {
+		var err error
+		if f, err = strconv.ParseFloat(v, 64); err != nil {
+			fatal("invalid setting", "setting", key, "value", v, "error", err)
+		}
+	}
+	noteSetting(key, f)
+	return f
+}
+
+func envInt(key string, fallback int) int {
+	n := fallback
+	if v := setting(key); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			fatal("invalid setting", "setting", key, "value", v, "error", err)
+		}
 	}
-	return fallback
+	noteSetting(key, n)
+	return n
 }
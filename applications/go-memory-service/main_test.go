@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+func TestBankFor(t *testing.T) {
+	tests := []struct {
+		userID  string
+		want    string
+		wantErr bool
+	}{
+		{userID: "alice", want: "user-alice"},
+		{userID: "Alice", want: "user-alice"},
+		{userID: "a-b", want: "user-a-b"},
+		{userID: "first.last_99", want: "user-first.last_99"},
+		{userID: "", wantErr: true},
+		{userID: "A/B", wantErr: true},
+		{userID: "a b", wantErr: true},
+		{userID: "../admin", wantErr: true},
+		{userID: "zoë", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := bankFor("", tt.userID)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("bankFor(%q) = %q, want error", tt.userID, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("bankFor(%q) = %q, %v; want %q", tt.userID, got, err, tt.want)
+		}
+	}
+}
+
+func TestBankForNoCollisions(t *testing.T) {
+	// Each of these either maps to its own bank or is rejected; none may
+	// share a bank with another.
+	ids := []string{"a-b", "A/B", "a_b", "a.b", "a b", "a%2Fb", "ab"}
+
+	seen := make(map[string]string)
+	for _, id := range ids {
+		bankID, err := bankFor("", id)
+		if err != nil {
+			continue
+		}
+		if prev, ok := seen[bankID]; ok {
+			t.Errorf("bankFor(%q) and bankFor(%q) both map to %q", prev, id, bankID)
+		}
+		seen[bankID] = id
+	}
+}
+
+func TestBankForTenants(t *testing.T) {
+	tests := []struct {
+		tenant  string
+		userID  string
+		want    string
+		wantErr bool
+	}{
+		{tenant: "", userID: "alice", want: "user-alice"},
+		{tenant: "acme", userID: "alice", want: "user-acme-alice"},
+		{tenant: "ACME", userID: "Alice", want: "user-acme-alice"},
+		{tenant: "acme.eu", userID: "alice", want: "user-acme.eu-alice"},
+		{tenant: "ac-me", userID: "alice", wantErr: true},
+		{tenant: "acme/x", userID: "alice", wantErr: true},
+		{tenant: "acme", userID: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := bankFor(tt.tenant, tt.userID)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("bankFor(%q, %q) = %q, want error", tt.tenant, tt.userID, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("bankFor(%q, %q) = %q, %v; want %q", tt.tenant, tt.userID, got, err, tt.want)
+		}
+	}
+}
+
+func TestBankForTenantIsolation(t *testing.T) {
+	// The same user in different tenants, and different splits of the same
+	// characters between tenant and user, must never share a bank.
+	pairs := [][2]string{
+		{"acme", "alice"}, {"globex", "alice"}, {"acme", "b-c"}, {"acme.b", "c"},
+		{"a", "b-c"}, {"a", "b"}, {"ab", "c"}, {"a", "bc"},
+	}
+
+	seen := make(map[string][2]string)
+	for _, p := range pairs {
+		bankID, err := bankFor(p[0], p[1])
+		if err != nil {
+			continue
+		}
+		if prev, ok := seen[bankID]; ok {
+			t.Errorf("bankFor%q and bankFor%q both map to %q", prev, p, bankID)
+		}
+		seen[bankID] = p
+	}
+
+	prev := bankPrefix
+	t.Cleanup(func() { bankPrefix = prev })
+	bankPrefix = "staging-"
+	if got, _ := bankFor("acme", "alice"); got != "staging-acme-alice" {
+		t.Errorf("bankFor with BANK_PREFIX staging- = %q, want staging-acme-alice", got)
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		wantErr bool
+	}{
+		{tmpl: "Memory for {userID}"},
+		{tmpl: "Support assistant"},
+		{tmpl: "{userID}'s assistant for {userID}"},
+		{tmpl: "Memory for {user}", wantErr: true},
+		{tmpl: "Memory for {}", wantErr: true},
+		{tmpl: "{userID} in {tenant}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := validateTemplate("BANK_NAME_TEMPLATE", tt.tmpl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateTemplate(%q) error = %v, wantErr %v", tt.tmpl, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tooMany := make([]string, maxTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("t%d", i)
+	}
+
+	tests := []struct {
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{in: nil, want: nil},
+		{in: []string{"project"}, want: []string{"project"}},
+		{in: []string{" Project ", "GO", "go"}, want: []string{"project", "go"}},
+		{in: []string{"b", "a", "B", "A"}, want: []string{"b", "a"}},
+		{in: append(tooMany[:maxTags:maxTags], "T0"), want: tooMany[:maxTags]},
+		{in: []string{"ok", "  "}, wantErr: true},
+		{in: tooMany, wantErr: true},
+		{in: []string{"Expires:1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeTags(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeTags(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("normalizeTags(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseBudget(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    hindsight.Budget
+		wantErr bool
+	}{
+		{in: "", want: hindsight.MID},
+		{in: "   ", want: hindsight.MID},
+		{in: "low", want: hindsight.LOW},
+		{in: "mid", want: hindsight.MID},
+		{in: "high", want: hindsight.HIGH},
+		{in: "HIGH", want: hindsight.HIGH},
+		{in: " Low\t", want: hindsight.LOW},
+		{in: "medium", wantErr: true},
+		{in: "hi gh", wantErr: true},
+		{in: "max", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBudget(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBudget(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBudget(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidMaxTokens(t *testing.T) {
+	tests := []struct {
+		in      int32
+		want    int32
+		wantErr bool
+	}{
+		{in: 0, want: defaultMaxTokens},
+		{in: 1, want: 1},
+		{in: 8192, want: 8192},
+		{in: -1, wantErr: true},
+		{in: 8193, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := validMaxTokens(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("validMaxTokens(%d) = nil, want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("validMaxTokens(%d) = %v", tt.in, err)
+		}
+		if got := recallMaxTokens(tt.in); got != tt.want {
+			t.Errorf("recallMaxTokens(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	// The default never exceeds a lower limit
+	defer func(limit int32) { maxTokensLimit = limit }(maxTokensLimit)
+	maxTokensLimit = 1000
+	if got := recallMaxTokens(0); got != 1000 {
+		t.Errorf("recallMaxTokens(0) with a limit of 1000 = %d", got)
+	}
+}
+
+func TestSplitCallError(t *testing.T) {
+	httpResp := &http.Response{StatusCode: http.StatusNotFound}
+	if resp, err := splitCallError(fmt.Errorf("ask: %w", &callError{httpResp: httpResp, err: errOverloaded})); resp != httpResp || err != errOverloaded {
+		t.Errorf("splitCallError of a wrapped *callError = %v, %v", resp, err)
+	}
+
+	// Errors from before any call have no response, and don't panic
+	w := httptest.NewRecorder()
+	writeRecallError(w, errOverloaded)
+	checkResponse(t, w, http.StatusServiceUnavailable, "overloaded")
+	if detail := recallErrorDetail(errOverloaded); detail.Code != "overloaded" {
+		t.Errorf("recallErrorDetail(errOverloaded) = %+v", detail)
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	if got := normalizeQuery("What's my name?"); got != "What's my name?" {
+		t.Errorf("normalizeQuery with NORMALIZE_QUERY unset = %q, want it unchanged", got)
+	}
+
+	normalizeQueries = true
+	defer func() { normalizeQueries = false }()
+	for in, want := range map[string]string{
+		"What's my name?":       "what's my name",
+		"  what's   my\tname  ": "what's my name",
+		"Which editor?!…":       "which editor",
+		"C++":                   "c++",
+		"?":                     "",
+	} {
+		if got := normalizeQuery(in); got != want {
+			t.Errorf("normalizeQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRecallQueryConfig(t *testing.T) {
+	prevQuery, prevRequire := defaultRecallQuery, requireRecallQuery
+	t.Cleanup(func() { defaultRecallQuery, requireRecallQuery = prevQuery, prevRequire })
+
+	t.Setenv("DEFAULT_RECALL_QUERY", "Qu'est-ce que tu sais ?")
+	loadRecallQueryConfig()
+
+	got, err := recallQuery(httptest.NewRequest("GET", "/recall/alice", nil))
+	if err != nil || got != "Qu'est-ce que tu sais ?" {
+		t.Errorf("recallQuery without q = %q, %v; want the DEFAULT_RECALL_QUERY override", got, err)
+	}
+	got, err = recallQuery(httptest.NewRequest("GET", "/recall/alice?q=editor", nil))
+	if err != nil || got != "editor" {
+		t.Errorf("recallQuery with q = %q, %v; want %q", got, err, "editor")
+	}
+
+	t.Setenv("RECALL_REQUIRE_QUERY", "true")
+	loadRecallQueryConfig()
+	if got, err := recallQuery(httptest.NewRequest("GET", "/recall/alice", nil)); err == nil {
+		t.Errorf("recallQuery without q = %q with RECALL_REQUIRE_QUERY set, want error", got)
+	}
+}
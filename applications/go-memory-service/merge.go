@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// MergeBanksRequest is the body of POST /bank/merge.
+type MergeBanksRequest struct {
+	FromUser string `json:"from_user"`
+	ToUser   string `json:"to_user"`
+	// DeleteSource deletes from_user's bank, but only once every memory
+	// was copied
+	DeleteSource bool `json:"delete_source"`
+}
+
+// handleMergeBanks copies every memory of one user's bank into another's,
+// for a user whose ID changed. It is /export piped into /import, a page at
+// a time: the destination keeps its own memories, and memories whose text
+// it already has are skipped, so a merge that failed partway can be run
+// again. The source's settings move along unless the destination has its
+// own. It's only routed when SERVICE_AUTH_TOKEN is set, since it reads and
+// writes across users.
+func (s *Service) handleMergeBanks(w http.ResponseWriter, r *http.Request) {
+	var req MergeBanksRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.FromUser == "" || req.ToUser == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "from_user and to_user are required")
+		return
+	}
+	fromBank, ok := requestBank(w, r, req.FromUser)
+	if !ok {
+		return
+	}
+	toBank, ok := requestBank(w, r, req.ToUser)
+	if !ok {
+		return
+	}
+	if fromBank == toBank {
+		writeError(w, http.StatusBadRequest, "invalid_request", "from_user and to_user are the same user")
+		return
+	}
+
+	ctx := r.Context()
+	annotateBank(ctx, toBank)
+	extendDeadlines(w, streamTimeout)
+
+	exists, httpResp, err := s.bankExists(ctx, fromBank)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "bank_not_found", "no memories have been stored for from_user")
+		return
+	}
+
+	// Ensure bank exists
+	s.ensureBank(ctx, toBank, req.ToUser)
+
+	have := make(map[string]bool)
+	httpResp, err = s.listMemories(ctx, toBank, func(items []map[string]any) error {
+		for _, item := range items {
+			have[exportedMemory(item).Text] = true
+		}
+		return nil
+	})
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+
+	defer s.answers.invalidate(toBank)
+	defer s.stats.forget(toBank)
+	copied, duplicates, failed := 0, 0, 0
+	httpResp, err = s.listMemories(ctx, fromBank, func(items []map[string]any) error {
+		batch := make([]hindsight.MemoryItem, 0, len(items))
+		for _, item := range items {
+			m := exportedMemory(item)
+			if m.Text == "" {
+				failed++
+				continue
+			}
+			if have[m.Text] {
+				duplicates++
+				continue
+			}
+			have[m.Text] = true
+			batch = append(batch, memoryItem(m))
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		resp, httpResp, err := s.api.Retain(ctx, toBank, hindsight.RetainRequest{Items: batch})
+		if err != nil {
+			slog.WarnContext(ctx, "merge batch failed", "items", len(batch), "error", err)
+			failed += len(batch)
+			return nil
+		}
+		httpResp.Body.Close()
+		n := retainedCount(resp, len(batch))
+		copied += n
+		failed += len(batch) - n
+		return nil
+	})
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+
+	if settings := s.bankSettings.get(fromBank); settings != (BankSettings{}) && s.bankSettings.get(toBank) == (BankSettings{}) {
+		if err := s.bankSettings.set(toBank, settings); err != nil {
+			slog.ErrorContext(ctx, "copying bank settings failed", "error", err)
+		}
+	}
+
+	result := map[string]any{
+		"from_bank_id":       fromBank,
+		"to_bank_id":         toBank,
+		"copied":             copied,
+		"skipped_duplicates": duplicates,
+		"failed":             failed,
+		"source_deleted":     false,
+	}
+	// A source with memories left behind is kept, whatever was asked
+	if req.DeleteSource && failed == 0 {
+		_, httpResp, err := s.api.DeleteBank(ctx, fromBank)
+		if err != nil {
+			// The copy stands, so report it rather than fail the request
+			_, detail := hindsightError(httpResp, err)
+			slog.ErrorContext(ctx, "deleting merged bank failed", "bank_id", fromBank, "error", err)
+			result["delete_error"] = detail.Message
+		} else {
+			httpResp.Body.Close()
+			s.dropBank(ctx, fromBank)
+			result["source_deleted"] = true
+		}
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memory_service_handler_duration_seconds",
+		Help:    "Latency of HTTP handlers, by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	hindsightCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_service_hindsight_calls_total",
+		Help: "Hindsight API calls, by operation and result (success or error).",
+	}, []string{"operation", "result"})
+
+	answerCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_service_ask_cache_lookups_total",
+		Help: "Answer cache lookups for /ask, by result (hit or miss).",
+	}, []string{"result"})
+)
+
+// withMetrics records per-handler latency for every request served by next.
+// Handlers are labelled by the ServeMux pattern they matched, which the mux
+// stores on the request during routing.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		pattern := r.Pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		handlerDuration.WithLabelValues(pattern).Observe(time.Since(start).Seconds())
+	})
+}
+
+// countCall records the outcome of a single hindsight API call.
+func countCall(op string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	hindsightCalls.WithLabelValues(op, result).Inc()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithCORS(t *testing.T) {
+	// Preflights must be answered without reaching auth
+	h := withCORS([]string{"https://app.example"}, withAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{name: "preflight", method: "OPTIONS", origin: "https://app.example", wantStatus: http.StatusNoContent, wantOrigin: "https://app.example"},
+		{name: "allowed origin", method: "GET", origin: "https://app.example", wantStatus: http.StatusUnauthorized, wantOrigin: "https://app.example"},
+		{name: "other origin", method: "OPTIONS", origin: "https://evil.example", wantStatus: http.StatusUnauthorized},
+		{name: "no origin", method: "GET", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/recall/alice", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+		})
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	h := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp *http.Response
+		_ = resp.StatusCode
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/recall/alice", nil))
+	checkResponse(t, w, http.StatusInternalServerError, "internal_error")
+
+	// Once the response has started, the connection is aborted instead
+	h = withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("boom")
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/recall/alice", nil))
+	t.Error("started response: handler returned normally")
+}
+
+func TestWithBackendOverride(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	h := withBackendOverride(map[string]http.Handler{
+		"http://staging:8888": handler("staging"),
+	}, handler("default"))
+
+	tests := []struct {
+		header string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, "default"},
+		{"http://staging:8888", http.StatusOK, "staging"},
+		{"http://staging:8888/", http.StatusOK, "staging"},
+		{"http://other:8888", http.StatusBadRequest, ""},
+		{"not a url", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/recall/alice", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Hindsight-URL", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.header, w.Code, tt.status)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%q: served by %q, want %q", tt.header, w.Body.String(), tt.body)
+		}
+	}
+
+	// Without overrides the header is ignored
+	h = withBackendOverride(nil, handler("default"))
+	req := httptest.NewRequest("GET", "/recall/alice", nil)
+	req.Header.Set("X-Hindsight-URL", "http://other:8888")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Body.String() != "default" {
+		t.Errorf("overrides off: served by %q, want default", w.Body.String())
+	}
+}
+
+func TestWithGzip(t *testing.T) {
+	large := strings.Repeat("memory ", gzipMinSize)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+		wantGzip    bool
+	}{
+		{name: "large body", accept: "gzip, deflate", body: large, wantGzip: true},
+		{name: "small body", accept: "gzip", body: `{"ok":true}`},
+		{name: "not accepted", body: large},
+		{name: "refused", accept: "gzip;q=0", body: large},
+		{name: "event stream", accept: "gzip", contentType: "text/event-stream", body: large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", cmp.Or(tt.contentType, "application/json"))
+				io.WriteString(w, tt.body[:len(tt.body)/2])
+				io.WriteString(w, tt.body[len(tt.body)/2:])
+			}))
+			r := httptest.NewRequest("GET", "/export/alice", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			body := w.Body.String()
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzip = %v, want %v", got, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+			if body != tt.body {
+				t.Errorf("body is %d bytes, want the %d written", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestRequestHandlerAddsRequestAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestHandler{slog.NewJSONHandler(&buf, nil)})
+	ctx := context.WithValue(context.Background(), requestInfoKey, &requestInfo{id: "req-1", bankID: "user-alice"})
+	logger.WarnContext(ctx, "hindsight call failed", "operation", "recall")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["request_id"] != "req-1" || line["bank_id"] != "user-alice" || line["operation"] != "recall" {
+		t.Errorf("log line = %v, want request_id, bank_id and operation", line)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// backendOverrides returns a Service for each hindsight server in
+// BACKEND_OVERRIDE_ALLOWLIST when ALLOW_BACKEND_OVERRIDE is set, keyed by
+// normalized URL, for requests that pick their server with X-Hindsight-URL.
+// It returns nil when overrides are off.
+func backendOverrides(svc *Service) map[string]*Service {
+	if !envBool("ALLOW_BACKEND_OVERRIDE", false) {
+		return nil
+	}
+	allowed := splitList(envOr("BACKEND_OVERRIDE_ALLOWLIST", ""))
+	if len(allowed) == 0 {
+		fatal("ALLOW_BACKEND_OVERRIDE needs BACKEND_OVERRIDE_ALLOWLIST")
+	}
+
+	apiKey := envOr("HINDSIGHT_API_KEY", "")
+	overrides := make(map[string]*Service, len(allowed))
+	for _, raw := range allowed {
+		u, err := normalizeBackendURL(raw)
+		if err != nil {
+			fatal("invalid BACKEND_OVERRIDE_ALLOWLIST", "error", err)
+		}
+		client, err := newSDKClient([]string{u}, apiKey)
+		if err != nil {
+			fatal("configuring the hindsight client", "error", err)
+		}
+		overrides[u] = svc.forBackend(u, client)
+	}
+	slog.Warn("X-Hindsight-URL backend overrides enabled; this is meant for development and testing", "allowed", allowed)
+	return overrides
+}
+
+// normalizeBackendURL checks that raw is an http(s) URL and drops any
+// trailing slash, so allowlist entries and headers compare equal.
+func normalizeBackendURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// forBackend returns a Service configured like s that talks to api, the
+// client for the server at url. Its caches are its own, so banks ensured
+// and answers cached on one server are never taken for another's. Bank
+// settings belong to users rather than servers, so they are shared.
+func (s *Service) forBackend(url string, api hindsightAPI) *Service {
+	o := newService(api)
+	o.backends = []backend{{url: url, api: api}}
+	o.bankSettings = s.bankSettings
+	o.banks.ttl = s.banks.ttl
+	o.stats.ttl = s.stats.ttl
+	o.answers.ttl, o.answers.size = s.answers.ttl, s.answers.size
+	o.learns.ttl, o.learns.size = s.learns.ttl, s.learns.size
+	o.recent.window, o.recent.size = s.recent.window, s.recent.size
+	return o
+}
+
+// withBackendOverride sends requests carrying an X-Hindsight-URL header to
+// the handler for that server, refusing servers without one. Requests
+// without the header go to next. With no overrides the header is ignored.
+func withBackendOverride(overrides map[string]http.Handler, next http.Handler) http.Handler {
+	if len(overrides) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get("X-Hindsight-URL")
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, err := normalizeBackendURL(raw)
+		h, ok := overrides[u]
+		if err != nil || !ok {
+			writeError(w, http.StatusBadRequest, "invalid_request", "X-Hindsight-URL is not in BACKEND_OVERRIDE_ALLOWLIST")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+)
+
+// maxPreviewFacts caps the facts of a /preview-ask.
+const maxPreviewFacts = 50
+
+// PreviewAskRequest is the body of /preview-ask: a question answered under
+// a mission that isn't stored anywhere.
+type PreviewAskRequest struct {
+	Mission string   `json:"mission"`
+	Query   string   `json:"query"`
+	Facts   []string `json:"facts,omitempty"`
+	Budget  string   `json:"budget,omitempty"`
+}
+
+type PreviewAskResponse struct {
+	Answer string `json:"answer"`
+}
+
+// handlePreviewAsk answers a query under a candidate mission. hindsight's
+// reflect takes the mission from the bank, so the answer comes from a
+// throwaway bank created with the mission and deleted afterwards. The
+// facts are passed as reflect context rather than retained, so nothing is
+// stored, even briefly, and no user bank is touched.
+func (s *Service) handlePreviewAsk(w http.ResponseWriter, r *http.Request) {
+	var req PreviewAskRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Mission = strings.TrimSpace(req.Mission)
+	if req.Mission == "" || strings.TrimSpace(req.Query) == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "mission and query are required")
+		return
+	}
+	if len(req.Facts) > maxPreviewFacts {
+		writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("at most %d facts", maxPreviewFacts))
+		return
+	}
+	budget, err := parseBudget(req.Budget)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	bankID := "preview-" + newRequestID()
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, budget)
+
+	_, httpResp, err := s.api.CreateOrUpdateBank(ctx, bankID, hindsight.CreateBankRequest{
+		Name:    *hindsight.NewNullableString(hindsight.PtrString("Mission preview")),
+		Mission: *hindsight.NewNullableString(hindsight.PtrString(req.Mission)),
+	})
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	httpResp.Body.Close()
+	// Deleted even if the client leaves, so previews don't pile up
+	defer func() {
+		delCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		_, httpResp, err := s.api.DeleteBank(delCtx, bankID)
+		if err != nil {
+			slog.WarnContext(ctx, "deleting preview bank failed", "error", err)
+			return
+		}
+		httpResp.Body.Close()
+	}()
+
+	reflectReq := hindsight.ReflectRequest{
+		Query:  req.Query,
+		Budget: budget.Ptr(),
+	}
+	if len(req.Facts) > 0 {
+		var b strings.Builder
+		b.WriteString("Facts known about the user:")
+		for _, fact := range req.Facts {
+			b.WriteString("\n- ")
+			b.WriteString(fact)
+		}
+		reflectReq.Context = *hindsight.NewNullableString(hindsight.PtrString(b.String()))
+	}
+
+	resp, httpResp, err := s.api.Reflect(ctx, bankID, reflectReq)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	httpResp.Body.Close()
+
+	writeJSON(w, PreviewAskResponse{Answer: resp.GetText()})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter hands out a token bucket per key (a bank ID, or the remote IP
+// for requests without a user). Buckets idle for longer than idleTTL are
+// dropped so the map doesn't grow with every user ever seen.
+type rateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	idleTTL time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		idleTTL: 5 * time.Minute,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// reserve takes a token for key. If none is available it returns how long
+// the caller should wait before trying again.
+func (l *rateLimiter) reserve(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	res := b.limiter.Reserve()
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// cleanup drops idle buckets every interval until ctx is done.
+func (l *rateLimiter) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, b := range l.buckets {
+				if now.Sub(b.lastSeen) > l.idleTTL {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// withRateLimit rejects requests over the caller's rate with 429 and a
+// Retry-After header. It wraps individual routes so path values such as
+// {userID} are available when choosing the bucket. A nil limiter disables
+// limiting.
+func withRateLimit(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := l.reserve(rateKey(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateKey picks the bucket for a request: the bank of the user in the path,
+// ?user= or JSON body, falling back to the remote IP. The body is restored after
+// peeking so the handler can still decode it.
+func rateKey(r *http.Request) string {
+	userID := cmp.Or(r.PathValue("userID"), r.URL.Query().Get("user"))
+	if userID == "" && r.Body != nil {
+		// Whatever was read is replayed ahead of the rest of the body, so a
+		// read error (such as a body limit) still reaches the handler
+		body, err := io.ReadAll(r.Body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err == nil {
+			var peek struct {
+				UserID string `json:"user_id"`
+			}
+			json.Unmarshal(body, &peek)
+			userID = peek.UserID
+		}
+	}
+	if bankID, err := bankFor(r.Header.Get("X-Tenant-ID"), userID); err == nil {
+		return bankID
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// maxReplay caps ?n= on /replay.
+const maxReplay = 20
+
+// Metadata keys of a stored interaction. hindsight may reword the memory's
+// text while extracting facts, so the question and answer are kept in its
+// metadata for /replay.
+const (
+	interactionQueryKey  = "query"
+	interactionAnswerKey = "answer"
+)
+
+// formatInteraction renders an ask as the memory stored for it.
+func formatInteraction(query, answer string) string {
+	return "User asked: " + strconv.Quote(query) + "\nAssistant answered: " + answer
+}
+
+// interactionMetadata returns the memory item metadata recording an ask.
+func interactionMetadata(query, answer string) map[string]string {
+	return map[string]string{interactionQueryKey: query, interactionAnswerKey: answer}
+}
+
+// storedInteraction returns the question and answer of a listed memory
+// stored for an ask. It fails for interactions stored without metadata.
+func storedInteraction(item map[string]any) (query, answer string, ok bool) {
+	metadata, _ := item["metadata"].(map[string]any)
+	query, _ = metadata[interactionQueryKey].(string)
+	answer, _ = metadata[interactionAnswerKey].(string)
+	return query, answer, query != ""
+}
+
+type ReplayResponse struct {
+	BankID  string         `json:"bank_id"`
+	Results []ReplayResult `json:"results"`
+}
+
+// ReplayResult is one stored interaction asked again. Error is set, and
+// NewAnswer empty, if the new ask failed.
+type ReplayResult struct {
+	Query     string       `json:"query"`
+	AskedAt   string       `json:"asked_at,omitempty"`
+	OldAnswer string       `json:"old_answer"`
+	NewAnswer string       `json:"new_answer"`
+	Changed   bool         `json:"changed"`
+	Error     *ErrorDetail `json:"error,omitempty"`
+}
+
+// handleReplay asks the user's n most recent stored interactions again,
+// without storing them, and returns the old and new answers side by side.
+// Interactions are found by listing the bank for memories with
+// interactionContext, newest first by the time hindsight reports they
+// were mentioned. ?budget= and the user's settings pick the budget as for
+// /ask.
+func (s *Service) handleReplay(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	n, err := intParam(r, "n", 5, 1, maxReplay)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	requested := r.URL.Query().Get("budget")
+	budget, err := parseBudget(requested)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_budget", err.Error())
+		return
+	}
+
+	bankID, ok := requestBank(w, r, userID)
+	if !ok {
+		return
+	}
+	budget, maxTokens := s.bankSettings.get(bankID).applyTo(requested, budget, 0)
+
+	ctx := r.Context()
+	annotateBank(ctx, bankID)
+	annotateBudget(ctx, budget)
+
+	exists, httpResp, err := s.bankExists(ctx, bankID)
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "bank_not_found", "no memories have been stored for this user")
+		return
+	}
+
+	type candidate struct {
+		ReplayResult
+		at time.Time
+	}
+	var found []candidate
+	httpResp, err = s.listMemories(ctx, bankID, func(items []map[string]any) error {
+		for _, item := range items {
+			m := exportedMemory(item)
+			if m.Context != interactionContext {
+				continue
+			}
+			query, answer, ok := storedInteraction(item)
+			if !ok {
+				continue
+			}
+			c := candidate{ReplayResult: ReplayResult{Query: query, OldAnswer: answer}, at: memoryTime(item)}
+			if !c.at.IsZero() {
+				c.AskedAt = c.at.Format(time.RFC3339)
+			}
+			found = append(found, c)
+		}
+		return nil
+	})
+	if err != nil {
+		writeHindsightError(w, httpResp, err)
+		return
+	}
+
+	// Newest first; memories without a time sort last, in listed order
+	slices.SortStableFunc(found, func(a, b candidate) int { return b.at.Compare(a.at) })
+	results := []ReplayResult{}
+	for _, c := range found {
+		// A question asked more than once is replayed for its latest answer
+		if !slices.ContainsFunc(results, func(r ReplayResult) bool { return r.Query == c.Query }) {
+			results = append(results, c.ReplayResult)
+		}
+		if len(results) == n {
+			break
+		}
+	}
+
+	opts := askOptionsFor(r)
+	store := false
+	var g errgroup.Group
+	g.SetLimit(askBatchConcurrency)
+	for i := range results {
+		g.Go(func() error {
+			resp, err := s.askShared(ctx, bankID, AskRequest{
+				UserID:           userID,
+				Query:            results[i].Query,
+				MaxTokens:        maxTokens,
+				StoreInteraction: &store,
+			}, budget, opts)
+			if err != nil {
+				_, detail := hindsightError(splitCallError(err))
+				results[i].Error = &detail
+				return nil
+			}
+			results[i].NewAnswer = resp.Answer
+			results[i].Changed = resp.Answer != results[i].OldAnswer
+			return nil
+		})
+	}
+	g.Wait()
+
+	writeJSON(w, ReplayResponse{BankID: bankID, Results: results})
+}
+
+// memoryTime returns when a listed memory was mentioned, or the zero time
+// if the listing doesn't say.
+func memoryTime(item map[string]any) time.Time {
+	for _, key := range []string{"mentioned_at", "date"} {
+		if v, ok := item[key].(string); ok {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
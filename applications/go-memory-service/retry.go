@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// maxRetries is how many times a failed hindsight call is retried
+// (HINDSIGHT_MAX_RETRIES). Zero disables retrying.
+var maxRetries = 3
+
+// execute runs the hindsight API call named op, retrying transient failures with
+// exponential backoff and jitter. Idempotent calls are retried on 5xx
+// responses and network errors. Non-idempotent calls (retains) are only
+// retried when the connection failed before the request was sent, so a
+// retry can never store a memory twice. Each attempt holds a slot on the
+// inflight semaphore, so a saturated service fails fast with errOverloaded,
+// and while the circuit breaker is open calls fail with errCircuitOpen
+// without being attempted.
+//
+// Pass the builder's Execute method value, e.g.
+//
+//	execute(ctx, "recall", true, s.c.MemoryAPI.RecallMemories(ctx, bankID).RecallRequest(req).Execute)
+func execute[T any](ctx context.Context, op string, idempotent bool, call func() (T, *http.Response, error)) (T, *http.Response, error) {
+	if !breaker.allow() {
+		countCall(op, errCircuitOpen)
+		slog.DebugContext(ctx, "hindsight call skipped", "operation", op, "error", errCircuitOpen)
+		var zero T
+		return zero, nil, errCircuitOpen
+	}
+
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		// call is already bound to ctx, so the span times each attempt but
+		// outbound trace headers name the handler's span as parent
+		release, err := acquireInflight(ctx)
+		if err != nil {
+			countCall(op, err)
+			breaker.record(nil, err)
+			slog.WarnContext(ctx, "hindsight call failed", "operation", op, "error", err)
+			var zero T
+			return zero, nil, err
+		}
+		_, span := startCallSpan(ctx, op)
+		v, httpResp, err := call()
+		endCallSpan(span, httpResp, err)
+		release()
+		countCall(op, err)
+		if err == nil || attempt >= maxRetries || !retryable(err, httpResp, idempotent) {
+			breaker.record(httpResp, err)
+			if err != nil {
+				logCallError(ctx, op, attempt+1, httpResp, err)
+			}
+			return v, httpResp, err
+		}
+
+		// Jitter the wait to [delay/2, 3*delay/2) so concurrent retries spread out
+		wait := delay/2 + rand.N(delay)
+		select {
+		case <-ctx.Done():
+			breaker.record(httpResp, err)
+			return v, httpResp, err
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// logCallError logs a hindsight call that failed for good. A 404 is an
+// expected answer for a missing bank or memory, so it is only logged at
+// debug level.
+func logCallError(ctx context.Context, op string, attempts int, httpResp *http.Response, err error) {
+	level := slog.LevelWarn
+	args := []any{"operation", op, "attempts", attempts, "error", err}
+	if httpResp != nil {
+		args = append(args, "status", httpResp.StatusCode)
+		if httpResp.StatusCode == http.StatusNotFound {
+			level = slog.LevelDebug
+		}
+	}
+	slog.Log(ctx, level, "hindsight call failed", args...)
+}
+
+// retryable reports whether a failed call is worth another attempt.
+func retryable(err error, httpResp *http.Response, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if httpResp != nil {
+		return idempotent && httpResp.StatusCode >= http.StatusInternalServerError
+	}
+	if !idempotent {
+		return dialFailed(err)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dialFailed reports whether err happened while establishing the
+// connection, i.e. before any part of the request reached the server.
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	hindsight "github.com/vectorize-io/hindsight-client-go"
+	"golang.org/x/sync/singleflight"
+)
+
+// hindsightAPI is the subset of the hindsight API the service uses. Each
+// method returns the decoded response, the raw HTTP response (nil if the
+// request never got one) and an error, like the generated client does.
+type hindsightAPI interface {
+	Retain(ctx context.Context, bankID string, req hindsight.RetainRequest) (*hindsight.RetainResponse, *http.Response, error)
+	Recall(ctx context.Context, bankID string, req hindsight.RecallRequest) (*hindsight.RecallResponse, *http.Response, error)
+	Reflect(ctx context.Context, bankID string, req hindsight.ReflectRequest) (*hindsight.ReflectResponse, *http.Response, error)
+	ListMemories(ctx context.Context, bankID string, limit, offset int32) (*hindsight.ListMemoryUnitsResponse, *http.Response, error)
+	ClearMemories(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error)
+	DeleteMemory(ctx context.Context, bankID, memoryID string) (*hindsight.DeleteResponse, *http.Response, error)
+
+	CreateOrUpdateBank(ctx context.Context, bankID string, req hindsight.CreateBankRequest) (*hindsight.BankProfileResponse, *http.Response, error)
+	GetBankProfile(ctx context.Context, bankID string) (*hindsight.BankProfileResponse, *http.Response, error)
+	ListBanks(ctx context.Context) (*hindsight.BankListResponse, *http.Response, error)
+	DeleteBank(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error)
+
+	Version(ctx context.Context) (*hindsight.VersionResponse, *http.Response, error)
+}
+
+// Service holds what the HTTP handlers and CLI subcommands share: the
+// hindsight client, the cache of banks already ensured, the answer, stats,
+// idempotency and dedupe caches and the group that coalesces identical concurrent
+// asks. backends holds a client per configured server for diagnostics.
+type Service struct {
+	api      hindsightAPI
+	backends []backend
+	banks    *bankCache
+	answers  *answerCache
+	stats    *statsCache
+	learns   *idempotencyCache
+	recent   *dedupeCache
+	// bankSettings are per-user request defaults
+	bankSettings *bankSettingsStore
+	asks         singleflight.Group
+}
+
+// backend is one configured hindsight server and a client that only talks
+// to it.
+type backend struct {
+	url string
+	api hindsightAPI
+}
+
+// probe makes a single version call to the server and times it.
+func (b backend) probe(ctx context.Context) BackendStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	v, httpResp, err := b.api.Version(ctx)
+	status := BackendStatus{
+		ServerURL: b.url,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if httpResp != nil {
+		// Any HTTP answer means the server is reachable, even an error
+		status.Reachable = true
+		status.StatusCode = httpResp.StatusCode
+		httpResp.Body.Close()
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Version = v.GetApiVersion()
+	return status
+}
+
+func newService(api hindsightAPI) *Service {
+	return &Service{
+		api:     api,
+		banks:   newBankCache(10 * time.Minute),
+		answers: newAnswerCache(0, 1000),
+		stats:   newStatsCache(30 * time.Second),
+		learns:  newIdempotencyCache(time.Hour, 10000),
+		recent:  newDedupeCache(0, 10000),
+
+		bankSettings: newBankSettingsStore(),
+	}
+}
+
+// newSDKClient builds a client for the given hindsight servers. With
+// several, requests are built for the first and the transport fails over
+// between them.
+func newSDKClient(serverURLs []string, apiKey string) (sdkClient, error) {
+	cfg := hindsight.NewConfiguration()
+	cfg.Servers = hindsight.ServerConfigurations{
+		{URL: serverURLs[0]},
+	}
+	httpClient, err := newHTTPClient(serverURLs)
+	if err != nil {
+		return sdkClient{}, err
+	}
+	cfg.HTTPClient = httpClient
+	if apiKey != "" {
+		cfg.AddDefaultHeader("Authorization", "Bearer "+apiKey)
+	}
+	return sdkClient{hindsight.NewAPIClient(cfg)}, nil
+}
+
+// sdkClient implements hindsightAPI with the generated client. Every call
+// but Version goes through execute for retries, metrics and tracing.
+type sdkClient struct {
+	c *hindsight.APIClient
+}
+
+func (s sdkClient) Retain(ctx context.Context, bankID string, req hindsight.RetainRequest) (*hindsight.RetainResponse, *http.Response, error) {
+	return execute(ctx, "retain", false, s.c.MemoryAPI.RetainMemories(ctx, bankID).RetainRequest(req).Execute)
+}
+
+func (s sdkClient) Recall(ctx context.Context, bankID string, req hindsight.RecallRequest) (*hindsight.RecallResponse, *http.Response, error) {
+	return execute(ctx, "recall", true, s.c.MemoryAPI.RecallMemories(ctx, bankID).RecallRequest(req).Execute)
+}
+
+func (s sdkClient) Reflect(ctx context.Context, bankID string, req hindsight.ReflectRequest) (*hindsight.ReflectResponse, *http.Response, error) {
+	return execute(ctx, "reflect", true, s.c.MemoryAPI.Reflect(ctx, bankID).ReflectRequest(req).Execute)
+}
+
+func (s sdkClient) ListMemories(ctx context.Context, bankID string, limit, offset int32) (*hindsight.ListMemoryUnitsResponse, *http.Response, error) {
+	return execute(ctx, "list_memories", true, s.c.MemoryAPI.ListMemories(ctx, bankID).Limit(limit).Offset(offset).Execute)
+}
+
+func (s sdkClient) ClearMemories(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	return execute(ctx, "clear_memories", true, s.c.MemoryAPI.ClearBankMemories(ctx, bankID).Execute)
+}
+
+func (s sdkClient) DeleteMemory(ctx context.Context, bankID, memoryID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	return execute(ctx, "delete_memory", true, s.c.MemoryAPI.DeleteMemory(ctx, bankID, memoryID).Execute)
+}
+
+func (s sdkClient) CreateOrUpdateBank(ctx context.Context, bankID string, req hindsight.CreateBankRequest) (*hindsight.BankProfileResponse, *http.Response, error) {
+	return execute(ctx, "create_bank", true, s.c.BanksAPI.CreateOrUpdateBank(ctx, bankID).CreateBankRequest(req).Execute)
+}
+
+func (s sdkClient) GetBankProfile(ctx context.Context, bankID string) (*hindsight.BankProfileResponse, *http.Response, error) {
+	return execute(ctx, "get_bank", true, s.c.BanksAPI.GetBankProfile(ctx, bankID).Execute)
+}
+
+func (s sdkClient) ListBanks(ctx context.Context) (*hindsight.BankListResponse, *http.Response, error) {
+	return execute(ctx, "list_banks", true, s.c.BanksAPI.ListBanks(ctx).Execute)
+}
+
+func (s sdkClient) DeleteBank(ctx context.Context, bankID string) (*hindsight.DeleteResponse, *http.Response, error) {
+	return execute(ctx, "delete_bank", true, s.c.BanksAPI.DeleteBank(ctx, bankID).Execute)
+}
+
+// Version is the /health probe, so it is never retried: a slow backend
+// should fail the probe rather than stretch it.
+func (s sdkClient) Version(ctx context.Context) (*hindsight.VersionResponse, *http.Response, error) {
+	v, httpResp, err := s.c.MonitoringAPI.GetVersion(ctx).Execute()
+	countCall("version", err)
+	if err != nil {
+		logCallError(ctx, "version", 1, httpResp, err)
+	}
+	return v, httpResp, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// statsCache keeps each bank's /stats result for a short ttl, since
+// computing one lists every memory in the bank.
+type statsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]statsEntry
+}
+
+type statsEntry struct {
+	stats   MemoryStats
+	expires time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{ttl: ttl, entries: make(map[string]statsEntry)}
+}
+
+func (c *statsCache) get(bankID string) (MemoryStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[bankID]
+	if !ok || time.Now().After(entry.expires) {
+		return MemoryStats{}, false
+	}
+	return entry.stats, true
+}
+
+func (c *statsCache) put(bankID string, stats MemoryStats) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[bankID] = statsEntry{stats: stats, expires: now.Add(c.ttl)}
+}
+
+// forget drops bankID's cached stats, e.g. after its memories changed.
+func (c *statsCache) forget(bankID string) {
+	c.mu.Lock()
+	delete(c.entries, bankID)
+	c.mu.Unlock()
+}
+
+// clear drops every cached count and returns how many there were.
+func (c *statsCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	clear(c.entries)
+	return n
+}
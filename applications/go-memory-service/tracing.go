@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setupTracing installs a real provider.
+var tracer = otel.Tracer("go-memory-service")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set; the exporter reads that and the other standard OTEL_* variables
+// itself. Without an endpoint tracing stays a no-op. The returned function
+// flushes buffered spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(envOr("OTEL_SERVICE_NAME", "go-memory-service")),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// withTracing starts a server span per request, continuing any trace the
+// caller propagated. Spans are renamed to the matched route pattern once
+// the mux has routed the request.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+		}
+		span.SetAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.HTTPResponseStatusCode(rec.status),
+		)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// startCallSpan starts a client span for the hindsight operation op,
+// tagged with the bank and budget the current request resolved to.
+func startCallSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "hindsight."+op, trace.WithSpanKind(trace.SpanKindClient))
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		if info.bankID != "" {
+			span.SetAttributes(attribute.String("hindsight.bank_id", info.bankID))
+		}
+		if info.budget != "" {
+			span.SetAttributes(attribute.String("hindsight.budget", info.budget))
+		}
+	}
+	return ctx, span
+}
+
+// endCallSpan records the outcome of a hindsight call and ends its span.
+func endCallSpan(span trace.Span, httpResp *http.Response, err error) {
+	if httpResp != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(httpResp.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
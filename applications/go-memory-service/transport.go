@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// newHTTPClient builds the client used for all hindsight calls. Every
+// setting can be overridden from the environment; the defaults are:
+//
+//	HINDSIGHT_TIMEOUT                  60s  deadline for a whole call, body included; reflect can be slow
+//	HINDSIGHT_DIAL_TIMEOUT             5s   time to establish a TCP connection
+//	HINDSIGHT_RESPONSE_HEADER_TIMEOUT  60s  time to wait for response headers after sending
+//	HINDSIGHT_MAX_IDLE_CONNS           100  idle keep-alive connections across all hosts
+//	HINDSIGHT_MAX_IDLE_CONNS_PER_HOST  32   idle keep-alive connections per host (stdlib default is 2)
+//	HINDSIGHT_IDLE_CONN_TIMEOUT        90s  how long an idle connection is kept open
+//	HINDSIGHT_FAILOVER_COOLDOWN        30s  how long a failed server is skipped when several are configured
+func newHTTPClient(serverURLs []string) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   envDuration("HINDSIGHT_DIAL_TIMEOUT", 5*time.Second),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = envDuration("HINDSIGHT_RESPONSE_HEADER_TIMEOUT", 60*time.Second)
+	transport.MaxIdleConns = envInt("HINDSIGHT_MAX_IDLE_CONNS", 100)
+	transport.MaxIdleConnsPerHost = envInt("HINDSIGHT_MAX_IDLE_CONNS_PER_HOST", 32)
+	transport.IdleConnTimeout = envDuration("HINDSIGHT_IDLE_CONN_TIMEOUT", 90*time.Second)
+
+	var rt http.RoundTripper = transport
+	if len(serverURLs) > 1 {
+		failover, err := newFailoverTransport(transport, serverURLs, envDuration("HINDSIGHT_FAILOVER_COOLDOWN", 30*time.Second))
+		if err != nil {
+			return nil, err
+		}
+		rt = failover
+	}
+
+	return &http.Client{
+		Timeout:   envDuration("HINDSIGHT_TIMEOUT", 60*time.Second),
+		Transport: headerTransport{base: rt},
+	}, nil
+}
+
+// headerTransport forwards the inbound request ID and trace context on
+// every outbound hindsight call so both sides of a request can be
+// correlated. The generated client attaches the handler's context to each
+// request, which is where both are read from.
+type headerTransport struct {
+	base http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if id := requestID(req.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// webhookAttempts bounds delivery of a retain callback; failures after the
+// last attempt are logged and dropped.
+const webhookAttempts = 3
+
+// webhookClient delivers callbacks. It dials through dialCallback and
+// ignores proxy settings, so the address checked is the one connected to,
+// including for redirects and hosts whose DNS changes after validation.
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: dialCallback},
+}
+
+// callbackAllowedHosts (CALLBACK_ALLOWED_HOSTS), when set, are the only
+// hosts callback_url may name. They may resolve to private addresses,
+// for receivers inside the network; other hosts must be public.
+var callbackAllowedHosts []string
+
+// cgnatPrefix is the shared address space carriers use, which is neither
+// public nor covered by netip's IsPrivate.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip is a public unicast address a callback may
+// go to, ruling out loopback, link-local (including cloud metadata at
+// 169.254.169.254), private and unspecified addresses.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatPrefix.Contains(ip)
+}
+
+func callbackHostAllowed(host string) bool {
+	return slices.Contains(callbackAllowedHosts, strings.ToLower(host))
+}
+
+// dialCallback connects to a callback receiver, refusing non-public
+// addresses unless the host is in callbackAllowedHosts. The check runs on
+// each address the dialer actually connects to, after DNS resolution.
+func dialCallback(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if host, _, err := net.SplitHostPort(addr); err != nil || !callbackHostAllowed(host) {
+		d.Control = func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(ap.Addr()) {
+				return fmt.Errorf("callback address %s is not public", address)
+			}
+			return nil
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// RetainCallback is POSTed to an /ask callback_url once the background
+// retain of the interaction finishes.
+type RetainCallback struct {
+	BankID  string `json:"bank_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validateCallbackURL checks that a callback_url is an absolute http(s) URL
+// to an allowed host. Hosts given as non-public IP addresses, or
+// localhost, are rejected here; names resolving to one fail when dialed.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	host := u.Hostname()
+	if callbackHostAllowed(host) {
+		return nil
+	}
+	if len(callbackAllowedHosts) > 0 {
+		return fmt.Errorf("callback_url host %q is not in CALLBACK_ALLOWED_HOSTS", host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) || strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("callback_url host %q is not a public address", host)
+	}
+	return nil
+}
+
+// notifyCallback delivers payload to callbackURL, retrying with backoff up to
+// webhookAttempts times.
+func notifyCallback(ctx context.Context, callbackURL string, payload RetainCallback) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "encoding callback failed, not sent", "url", callbackURL, "error", err)
+		return
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postCallback(ctx, callbackURL, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts || ctx.Err() != nil {
+			slog.WarnContext(ctx, "callback failed", "url", callbackURL, "attempts", attempt, "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postCallback(ctx context.Context, callbackURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
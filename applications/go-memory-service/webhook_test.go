@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestValidateCallbackURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		allowed []string
+		ok      bool
+	}{
+		{url: "https://hooks.example.com/done", ok: true},
+		{url: "http://93.184.216.34:8080/cb", ok: true},
+		{url: "ftp://example.com/x"},
+		{url: "/relative"},
+		{url: "http://localhost:9000/cb"},
+		{url: "http://127.0.0.1/cb"},
+		{url: "http://[::1]/cb"},
+		{url: "http://169.254.169.254/latest/meta-data"},
+		{url: "http://10.0.0.5/cb"},
+		{url: "http://192.168.1.1/cb"},
+		{url: "http://100.64.0.1/cb"},
+		{url: "http://[::ffff:127.0.0.1]/cb"},
+		{url: "http://0.0.0.0/cb"},
+		// An allowlist admits its hosts, private or not, and nothing else
+		{url: "http://hooks.internal/cb", allowed: []string{"hooks.internal"}, ok: true},
+		{url: "http://10.0.0.5/cb", allowed: []string{"10.0.0.5"}, ok: true},
+		{url: "https://hooks.example.com/done", allowed: []string{"hooks.internal"}},
+	}
+	t.Cleanup(func() { callbackAllowedHosts = nil })
+	for _, tt := range tests {
+		callbackAllowedHosts = tt.allowed
+		if err := validateCallbackURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("validateCallbackURL(%q) with allowlist %v = %v, want ok %v", tt.url, tt.allowed, err, tt.ok)
+		}
+	}
+}
+
+func TestCallbackDialRejectsPrivateAddresses(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer srv.Close()
+	t.Cleanup(func() { callbackAllowedHosts = nil })
+
+	// The server is on loopback, so only an allowlisted host reaches it.
+	// Dialing is checked even for URLs that skipped validation, as a
+	// rebinding DNS name would.
+	if err := postCallback(context.Background(), srv.URL, []byte("{}")); err == nil || hits != 0 {
+		t.Fatalf("callback to loopback: err = %v, hits = %d; want it refused", err, hits)
+	}
+	u, _ := url.Parse(srv.URL)
+	callbackAllowedHosts = []string{u.Hostname()}
+	if err := postCallback(context.Background(), srv.URL, []byte("{}")); err != nil || hits != 1 {
+		t.Errorf("callback to an allowed host: err = %v, hits = %d; want it delivered", err, hits)
+	}
+}